@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/http_api"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 对一组nsqlookupd的HTTP接口的封装, 所有请求都是并发发给每一个nsqlookupd
+type lookupdClient struct {
+	addrs     []string
+	timeout   time.Duration
+	namespace string // 为空是默认namespace
+	token     string // namespace配置了ACL的时候用
+}
+
+func newLookupdClient(addrs []string, timeout time.Duration, namespace string, token string) *lookupdClient {
+	return &lookupdClient{
+		addrs:     addrs,
+		timeout:   timeout,
+		namespace: namespace,
+		token:     token,
+	}
+}
+
+// 单个nsqlookupd的返回
+type response struct {
+	Addr string          `json:"lookupd"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Err  string          `json:"error,omitempty"`
+}
+
+// 并发请求所有nsqlookupd, 返回的顺序和addrs一致
+func (c *lookupdClient) do(method string, path string, query url.Values) []*response {
+	return c.doBody(method, path, query, nil)
+}
+
+// 和do一样, 每个nsqlookupd都发送同样的body
+func (c *lookupdClient) doBody(method string, path string, query url.Values, body []byte) []*response {
+	responses := make([]*response, len(c.addrs))
+	var wg sync.WaitGroup
+	for i, addr := range c.addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			data, err := c.request(method, addr, path, query, body)
+			responses[i] = &response{Addr: addr, Data: data}
+			if err != nil {
+				responses[i].Err = err.Error()
+			}
+		}(i, addr)
+	}
+	wg.Wait()
+	return responses
+}
+
+func (c *lookupdClient) request(method string, addr string, path string, query url.Values, body []byte) ([]byte, error) {
+	// addr也可以是unix:///path/to.sock
+	client, endpoint := http_api.NewClient(addr, c.timeout)
+	endpoint += path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-NSQ-Namespace", c.namespace)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// nsqlookupd的错误都是 {"message": "XXX", "reason": "xxx"}, reason可能没有
+		var e struct {
+			Message string `json:"message"`
+			Reason  string `json:"reason"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			if e.Reason != "" {
+				return nil, fmt.Errorf("%d %s - %s", resp.StatusCode, e.Message, e.Reason)
+			}
+			return nil, fmt.Errorf("%d %s", resp.StatusCode, e.Message)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return data, nil
+}
@@ -0,0 +1,220 @@
+// lookupctl nsqlookupd的命令行管理工具
+// 可以同时操作多个nsqlookupd, 查询的时候会把结果合并,并且报告哪些nsqlookupd之间的数据不一致
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/version"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 可以重复指定的flag, 比如 -lookupd-http-address=a -lookupd-http-address=b
+type stringArray []string
+
+func (a *stringArray) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *stringArray) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*a = append(*a, v)
+		}
+	}
+	return nil
+}
+
+const usage = `Usage: lookupctl [flags] <command> [args]
+
+Commands:
+  topics                      list all topics
+  channels <topic>            list channels of a topic
+  lookup <topic>              list producers of a topic
+  nodes                       list all producers
+  create <topic> [channel]    create a topic (or a channel)
+  delete <topic> [channel]    delete a topic (and its channels) or a channel
+  tombstone <topic> <node>    tombstone a topic on a node (broadcast_address:http_port)
+  drain <node>                remove a node from all lookups (broadcast_address:http_port)
+  undrain <node>              return a drained node to lookups
+  export <file>               save all registrations of one lookupd to a file
+  import <file> [mode]        restore registrations from a file, mode is merge (default) or replace
+
+Flags:
+`
+
+type command struct {
+	args int // 最少需要几个参数
+	max  int // 最多几个参数
+	run  func(c *lookupdClient, args []string) (*result, error)
+}
+
+var commands = map[string]command{
+	"topics":    {0, 0, runTopics},
+	"channels":  {1, 1, runChannels},
+	"lookup":    {1, 1, runLookup},
+	"nodes":     {0, 0, runNodes},
+	"create":    {1, 2, runCreate},
+	"delete":    {1, 2, runDelete},
+	"tombstone": {2, 2, runTombstone},
+	"drain":     {1, 1, runDrain},
+	"undrain":   {1, 1, runUndrain},
+	"export":    {1, 1, runExport},
+	"import":    {1, 2, runImport},
+}
+
+func main() {
+	var addrs stringArray
+	flagSet := flag.NewFlagSet("lookupctl", flag.ExitOnError)
+	flagSet.Var(&addrs, "lookupd-http-address", "nsqlookupd HTTP address, host:port or unix://<path> (may be given multiple times or comma separated)")
+	output := flagSet.String("output", "table", "output format (table, json)")
+	timeout := flagSet.Duration("timeout", 5*time.Second, "timeout for each nsqlookupd request")
+	namespace := flagSet.String("namespace", "", "namespace to operate in (default namespace if empty)")
+	token := flagSet.String("token", "", "bearer token for namespaces with ACLs")
+	showVersion := flagSet.Bool("version", false, "print version string")
+	flagSet.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(os.Args[1:])
+
+	if *showVersion {
+		fmt.Println(version.String("lookupctl"))
+		return
+	}
+	if *output != "table" && *output != "json" {
+		fatalUsage(flagSet, "invalid -output %q", *output)
+	}
+	if len(addrs) == 0 {
+		addrs = stringArray{"127.0.0.1:4161"}
+	}
+
+	args := flagSet.Args()
+	if len(args) == 0 {
+		fatalUsage(flagSet, "missing command")
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fatalUsage(flagSet, "unknown command %q", args[0])
+	}
+	if len(args)-1 < cmd.args || len(args)-1 > cmd.max {
+		fatalUsage(flagSet, "wrong number of arguments for %q", args[0])
+	}
+
+	client := newLookupdClient(addrs, *timeout, *namespace, *token)
+	res, err := cmd.run(client, args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	if *output == "json" {
+		err = res.printJSON(os.Stdout)
+	} else {
+		err = res.printTable(os.Stdout, os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	// 有nsqlookupd请求失败的话返回非0,方便脚本判断
+	if res.failed() {
+		os.Exit(1)
+	}
+}
+
+func fatalUsage(flagSet *flag.FlagSet, f string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "ERROR: "+f+"\n\n", args...)
+	flagSet.Usage()
+	os.Exit(2)
+}
+
+func runTopics(c *lookupdClient, args []string) (*result, error) {
+	responses := c.do("GET", "/topics", nil)
+	return mergeList([]string{"TOPIC"}, responses, parseTopics)
+}
+
+func runChannels(c *lookupdClient, args []string) (*result, error) {
+	query := url.Values{"topic": {args[0]}}
+	responses := c.do("GET", "/channels", query)
+	return mergeList([]string{"CHANNEL"}, responses, parseChannels)
+}
+
+func runLookup(c *lookupdClient, args []string) (*result, error) {
+	query := url.Values{"topic": {args[0]}}
+	responses := c.do("GET", "/lookup", query)
+	return mergeList([]string{"PRODUCER", "HOSTNAME", "HTTP_PORT", "VERSION"}, responses, parseLookup)
+}
+
+func runNodes(c *lookupdClient, args []string) (*result, error) {
+	responses := c.do("GET", "/nodes", nil)
+	return mergeList([]string{"PRODUCER", "HOSTNAME", "HTTP_PORT", "VERSION", "TOPICS"}, responses, parseNodes)
+}
+
+func runCreate(c *lookupdClient, args []string) (*result, error) {
+	if len(args) == 2 {
+		query := url.Values{"topic": {args[0]}, "channel": {args[1]}}
+		return actionResult(c.do("POST", "/channel/create", query)), nil
+	}
+	query := url.Values{"topic": {args[0]}}
+	return actionResult(c.do("POST", "/topic/create", query)), nil
+}
+
+func runDelete(c *lookupdClient, args []string) (*result, error) {
+	if len(args) == 2 {
+		query := url.Values{"topic": {args[0]}, "channel": {args[1]}}
+		return actionResult(c.do("POST", "/channel/delete", query)), nil
+	}
+	query := url.Values{"topic": {args[0]}}
+	return actionResult(c.do("POST", "/topic/delete", query)), nil
+}
+
+func runTombstone(c *lookupdClient, args []string) (*result, error) {
+	query := url.Values{"topic": {args[0]}, "node": {args[1]}}
+	return actionResult(c.do("POST", "/topic/tombstone", query)), nil
+}
+
+func runDrain(c *lookupdClient, args []string) (*result, error) {
+	query := url.Values{"node": {args[0]}}
+	return actionResult(c.do("POST", "/node/drain", query)), nil
+}
+
+func runUndrain(c *lookupdClient, args []string) (*result, error) {
+	query := url.Values{"node": {args[0]}}
+	return actionResult(c.do("POST", "/node/undrain", query)), nil
+}
+
+// 导出的文件是一个nsqlookupd的完整状态, 多个nsqlookupd的话不知道该用哪个
+func runExport(c *lookupdClient, args []string) (*result, error) {
+	if len(c.addrs) != 1 {
+		return nil, fmt.Errorf("export needs exactly one -lookupd-http-address")
+	}
+	responses := c.do("GET", "/debug/registrations", nil)
+	if resp := responses[0]; resp.Err == "" {
+		err := ioutil.WriteFile(args[0], resp.Data, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return actionResult(responses), nil
+}
+
+// 导入到所有的nsqlookupd
+func runImport(c *lookupdClient, args []string) (*result, error) {
+	mode := "merge"
+	if len(args) == 2 {
+		mode = args[1]
+	}
+	if mode != "merge" && mode != "replace" {
+		return nil, fmt.Errorf("invalid import mode %q", mode)
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{"mode": {mode}}
+	return actionResult(c.doBody("POST", "/debug/registrations", query, data)), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// 合并之后的一行, 比如一个topic或者一个producer
+type item struct {
+	Key      string   `json:"key"`
+	Columns  []string `json:"columns"`
+	Lookupds []string `json:"lookupds"`          // 哪些nsqlookupd上有
+	Missing  []string `json:"missing,omitempty"` // 哪些(正常返回了的)nsqlookupd上没有
+	Differs  bool     `json:"differs,omitempty"` // 都有,但是内容不一样,比如同一个nsqd上的topic不一样
+}
+
+type result struct {
+	Header     []string    `json:"header,omitempty"`
+	Items      []*item     `json:"items,omitempty"`
+	Consistent bool        `json:"consistent"`
+	Responses  []*response `json:"responses"`
+}
+
+func (r *result) failed() bool {
+	for _, resp := range r.Responses {
+		if resp.Err != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 把每个nsqlookupd返回的数据解析成[]*item
+type parseFunc func(data []byte) ([]*item, error)
+
+// 合并所有nsqlookupd的列表, 某一项不是所有正常返回的nsqlookupd都有的话就是不一致
+func mergeList(header []string, responses []*response, parse parseFunc) (*result, error) {
+	res := &result{Header: header, Consistent: true, Responses: responses}
+	merged := make(map[string]*item)
+	var ok []string // 正常返回的nsqlookupd
+	for _, resp := range responses {
+		if resp.Err != "" {
+			continue
+		}
+		items, err := parse(resp.Data)
+		if err != nil {
+			resp.Err = fmt.Sprintf("failed to parse response - %s", err)
+			continue
+		}
+		ok = append(ok, resp.Addr)
+		for _, it := range items {
+			m, found := merged[it.Key]
+			if !found {
+				m = it
+				merged[it.Key] = m
+			} else if strings.Join(m.Columns, "\t") != strings.Join(it.Columns, "\t") {
+				m.Differs = true
+				res.Consistent = false
+			}
+			m.Lookupds = append(m.Lookupds, resp.Addr)
+		}
+	}
+
+	for _, it := range merged {
+		if len(it.Lookupds) == len(ok) {
+			continue
+		}
+		res.Consistent = false
+		has := make(map[string]bool)
+		for _, addr := range it.Lookupds {
+			has[addr] = true
+		}
+		for _, addr := range ok {
+			if !has[addr] {
+				it.Missing = append(it.Missing, addr)
+			}
+		}
+	}
+
+	res.Items = make([]*item, 0, len(merged))
+	for _, it := range merged {
+		res.Items = append(res.Items, it)
+	}
+	sort.Slice(res.Items, func(i, j int) bool {
+		return res.Items[i].Key < res.Items[j].Key
+	})
+	return res, nil
+}
+
+// create delete tombstone 这种操作只需要看每个nsqlookupd成功没有
+func actionResult(responses []*response) *result {
+	res := &result{Consistent: true, Responses: responses}
+	for _, resp := range responses {
+		if resp.Err != "" {
+			res.Consistent = false
+		}
+		// 操作成功的时候返回的是{},没必要输出
+		resp.Data = nil
+	}
+	return res
+}
+
+func (r *result) printJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *result) printTable(w io.Writer, errw io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if r.Header == nil {
+		// 操作类的命令
+		fmt.Fprintln(tw, "LOOKUPD\tRESULT")
+		for _, resp := range r.Responses {
+			status := "OK"
+			if resp.Err != "" {
+				status = "ERROR: " + resp.Err
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", resp.Addr, status)
+		}
+		return tw.Flush()
+	}
+
+	fmt.Fprintf(tw, "%s\tLOOKUPDS\tMISSING FROM\n", strings.Join(r.Header, "\t"))
+	total := 0
+	for _, resp := range r.Responses {
+		if resp.Err == "" {
+			total++
+		}
+	}
+	for _, it := range r.Items {
+		missing := "-"
+		if len(it.Missing) > 0 {
+			missing = strings.Join(it.Missing, ",")
+		}
+		if it.Differs {
+			missing = "(differs)"
+			if len(it.Missing) > 0 {
+				missing = strings.Join(it.Missing, ",") + " (differs)"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\n", strings.Join(it.Columns, "\t"), len(it.Lookupds), total, missing)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, resp := range r.Responses {
+		if resp.Err != "" {
+			fmt.Fprintf(errw, "WARNING: lookupd %s - %s\n", resp.Addr, resp.Err)
+		}
+	}
+	if !r.Consistent {
+		fmt.Fprintln(errw, "WARNING: lookupds disagree")
+	}
+	return nil
+}
+
+func parseTopics(data []byte) ([]*item, error) {
+	var resp struct {
+		Topics []string `json:"topics"`
+	}
+	err := json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return stringItems(resp.Topics), nil
+}
+
+func parseChannels(data []byte) ([]*item, error) {
+	var resp struct {
+		Channels []string `json:"channels"`
+	}
+	err := json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return stringItems(resp.Channels), nil
+}
+
+func stringItems(ss []string) []*item {
+	items := make([]*item, len(ss))
+	for i, s := range ss {
+		items[i] = &item{Key: s, Columns: []string{s}}
+	}
+	return items
+}
+
+type producer struct {
+	Hostname         string   `json:"hostname"`
+	BroadcastAddress string   `json:"broadcast_address"`
+	TCPPort          int      `json:"tcp_port"`
+	HTTPPort         int      `json:"http_port"`
+	Version          string   `json:"version"`
+	Topics           []string `json:"topics"`
+}
+
+// 同一个nsqd在不同nsqlookupd上的remote_address可能不一样,所以用broadcast_address:tcp_port作为key
+func (p *producer) key() string {
+	return p.BroadcastAddress + ":" + strconv.Itoa(p.TCPPort)
+}
+
+func parseLookup(data []byte) ([]*item, error) {
+	var resp struct {
+		Producers []*producer `json:"producers"`
+	}
+	err := json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*item, len(resp.Producers))
+	for i, p := range resp.Producers {
+		items[i] = &item{
+			Key:     p.key(),
+			Columns: []string{p.key(), p.Hostname, strconv.Itoa(p.HTTPPort), p.Version},
+		}
+	}
+	return items, nil
+}
+
+func parseNodes(data []byte) ([]*item, error) {
+	var resp struct {
+		Producers []*producer `json:"producers"`
+	}
+	err := json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*item, len(resp.Producers))
+	for i, p := range resp.Producers {
+		sort.Strings(p.Topics)
+		items[i] = &item{
+			Key:     p.key(),
+			Columns: []string{p.key(), p.Hostname, strconv.Itoa(p.HTTPPort), p.Version, strings.Join(p.Topics, ",")},
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 记录所有的延迟, 最后排序算百分位
+// 压测的量级是几十万个样本,直接存下来比分桶简单也更准
+type histogram struct {
+	sync.Mutex
+	samples []time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{}
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.Lock()
+	h.samples = append(h.samples, d)
+	h.Unlock()
+}
+
+// p取值 0-100
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted))*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+func (h *histogram) sorted() []time.Duration {
+	h.Lock()
+	sorted := make([]time.Duration, len(h.samples))
+	copy(sorted, h.samples)
+	h.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// elapsed不为0的时候另外打印每秒完成多少次
+func (h *histogram) print(name string, elapsed time.Duration) {
+	sorted := h.sorted()
+	rate := ""
+	if elapsed > 0 {
+		rate = fmt.Sprintf(" (%.1f/s)", float64(len(sorted))/elapsed.Seconds())
+	}
+	if len(sorted) == 0 {
+		fmt.Printf("  %-22s n=0%s\n", name, rate)
+		return
+	}
+	fmt.Printf("  %-22s n=%d%s p50=%s p90=%s p99=%s p99.9=%s max=%s\n",
+		name, len(sorted), rate,
+		percentile(sorted, 50),
+		percentile(sorted, 90),
+		percentile(sorted, 99),
+		percentile(sorted, 99.9),
+		sorted[len(sorted)-1])
+}
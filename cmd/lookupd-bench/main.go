@@ -0,0 +1,279 @@
+// lookupd-bench 模拟大量nsqd连接nsqlookupd,用来评估nsqlookupd的容量
+// 先建立N个连接,每个连接IDENTIFY之后注册M个topic(每个topic K个channel)
+// 然后按配置的速率不停地 注册/取消注册 和 断开/重连, 同时测HTTP /lookup 的延迟
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/version"
+	"github.com/xswwhy/nsq/lookupclient"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	tcpAddress   = flag.String("lookupd-tcp-address", "127.0.0.1:4160", "nsqlookupd TCP address")
+	httpAddress  = flag.String("lookupd-http-address", "127.0.0.1:4161", "nsqlookupd HTTP address")
+	peers        = flag.Int("peers", 100, "number of simulated nsqd connections")
+	topics       = flag.Int("topics", 10, "topics registered by each peer")
+	channels     = flag.Int("channels", 2, "channels registered per topic")
+	topicPool    = flag.Int("topic-pool", 0, "number of distinct topic names shared by all peers (default: -topics)")
+	connectConc  = flag.Int("connect-concurrency", 50, "number of peers connecting at the same time")
+	duration     = flag.Duration("duration", 30*time.Second, "how long to run the churn/lookup phase")
+	churnRate    = flag.Float64("churn-rate", 100, "UNREGISTER+REGISTER pairs per second (0 to disable)")
+	reconnRate   = flag.Float64("reconnect-rate", 1, "peer disconnect+reconnect per second (0 to disable)")
+	lookupRate   = flag.Float64("lookup-rate", 200, "HTTP /lookup requests per second (0 to disable)")
+	lookupConc   = flag.Int("lookup-concurrency", 10, "number of concurrent HTTP lookup workers")
+	showVersion  = flag.Bool("version", false, "print version string")
+	httpClient   = &http.Client{Timeout: 5 * time.Second}
+	errorCounter int64
+)
+
+// 一个模拟的nsqd
+type peer struct {
+	sync.Mutex
+	id     int
+	client *lookupclient.Client
+}
+
+func main() {
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version.String("lookupd-bench"))
+		return
+	}
+	if *peers < 1 || *topics < 1 {
+		log.Fatal("-peers and -topics must be >= 1")
+	}
+	if *topicPool == 0 {
+		*topicPool = *topics
+	}
+	rand.Seed(time.Now().UnixNano())
+	log.SetPrefix("[lookupd-bench] ")
+
+	// 第一阶段: 建立连接并注册
+	log.Printf("connecting %d peers (%d topics x %d channels each) to %s", *peers, *topics, *channels, *tcpAddress)
+	all := make([]*peer, *peers)
+	connectLatency := newHistogram()
+	start := time.Now()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *connectConc)
+	for i := range all {
+		all[i] = &peer{id: i}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p *peer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t := time.Now()
+			err := p.connect()
+			if err != nil {
+				countError("connect peer %d - %s", p.id, err)
+				return
+			}
+			connectLatency.record(time.Since(t))
+		}(all[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	registrations := *peers * *topics * (1 + *channels)
+	fmt.Printf("setup: %d peers, %d registrations in %s (%.0f registrations/s)\n",
+		*peers, registrations, elapsed, float64(registrations)/elapsed.Seconds())
+	connectLatency.print("peer connect+register", 0)
+
+	// 第二阶段: churn + lookup
+	log.Printf("running churn/lookup phase for %s", *duration)
+	exitChan := make(chan struct{})
+	churnLatency := newHistogram()
+	reconnLatency := newHistogram()
+	lookupLatency := newHistogram()
+
+	if *churnRate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			every(*churnRate, exitChan, func() {
+				p := all[rand.Intn(len(all))]
+				t := time.Now()
+				err := p.churn()
+				if err != nil {
+					countError("churn peer %d - %s", p.id, err)
+					return
+				}
+				churnLatency.record(time.Since(t))
+			})
+		}()
+	}
+	if *reconnRate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			every(*reconnRate, exitChan, func() {
+				p := all[rand.Intn(len(all))]
+				t := time.Now()
+				err := p.reconnect()
+				if err != nil {
+					countError("reconnect peer %d - %s", p.id, err)
+					return
+				}
+				reconnLatency.record(time.Since(t))
+			})
+		}()
+	}
+	if *lookupRate > 0 {
+		// 限速的ticker分发给多个worker,慢请求不会拖慢发请求的速率
+		work := make(chan struct{}, *lookupConc)
+		for i := 0; i < *lookupConc; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range work {
+					t := time.Now()
+					err := lookup(fmt.Sprintf("bench-topic-%d", rand.Intn(*topicPool)))
+					if err != nil {
+						countError("lookup - %s", err)
+						continue
+					}
+					lookupLatency.record(time.Since(t))
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			every(*lookupRate, exitChan, func() {
+				select {
+				case work <- struct{}{}:
+				default:
+					countError("lookup workers saturated, dropping request")
+				}
+			})
+			close(work)
+		}()
+	}
+
+	time.Sleep(*duration)
+	close(exitChan)
+	wg.Wait()
+
+	fmt.Printf("\nchurn/lookup phase (%s):\n", *duration)
+	churnLatency.print("UNREGISTER+REGISTER", *duration)
+	reconnLatency.print("disconnect+reconnect", *duration)
+	lookupLatency.print("HTTP /lookup", *duration)
+	fmt.Printf("errors: %d\n", atomic.LoadInt64(&errorCounter))
+
+	for _, p := range all {
+		p.close()
+	}
+}
+
+// 按rate(每秒多少次)调用fn,直到exitChan关闭
+func every(rate float64, exitChan chan struct{}, fn func()) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-exitChan:
+			return
+		}
+	}
+}
+
+func (p *peer) topicName(i int) string {
+	return fmt.Sprintf("bench-topic-%d", (p.id*(*topics)+i)%(*topicPool))
+}
+
+func (p *peer) connect() error {
+	c := lookupclient.New(*tcpAddress, lookupclient.Config{
+		BroadcastAddress: fmt.Sprintf("bench-%d", p.id),
+		Hostname:         fmt.Sprintf("bench-%d", p.id),
+		TCPPort:          4150,
+		HTTPPort:         4151,
+		Version:          version.Binary,
+		Labels:           map[string]string{"env": "bench"},
+		PingInterval:     15 * time.Second,
+	})
+	_, err := c.Connect()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < *topics; i++ {
+		topic := p.topicName(i)
+		err = c.Register(topic, "")
+		for j := 0; j < *channels && err == nil; j++ {
+			err = c.Register(topic, fmt.Sprintf("bench-channel-%d", j))
+		}
+		if err != nil {
+			c.Close()
+			return err
+		}
+	}
+	p.Lock()
+	p.client = c
+	p.Unlock()
+	return nil
+}
+
+// 随机取消注册一个topic再注册回去
+func (p *peer) churn() error {
+	p.Lock()
+	c := p.client
+	p.Unlock()
+	if c == nil {
+		return fmt.Errorf("not connected")
+	}
+	topic := p.topicName(rand.Intn(*topics))
+	err := c.Unregister(topic, "")
+	if err != nil {
+		return err
+	}
+	return c.Register(topic, "")
+}
+
+// 断开之后重新连接并注册所有topic
+func (p *peer) reconnect() error {
+	p.close()
+	return p.connect()
+}
+
+func (p *peer) close() {
+	p.Lock()
+	c := p.client
+	p.client = nil
+	p.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+func lookup(topic string) error {
+	resp, err := httpClient.Get(fmt.Sprintf("http://%s/lookup?topic=%s", *httpAddress, topic))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	// topic可能刚好被churn掉了,404也算正常
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("got response %s", resp.Status)
+	}
+	return nil
+}
+
+func countError(f string, args ...interface{}) {
+	// 错误太多的时候只打印前面一些
+	if n := atomic.AddInt64(&errorCounter, 1); n <= 20 {
+		log.Printf("ERROR: "+f, args...)
+	} else if n == 21 {
+		log.Printf("ERROR: too many errors, suppressing further messages")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/nsqlookupd"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 配置文件是一个json对象, key是flag的名字把-换成_, 比如
+//
+//	{
+//	    "tcp_address": "0.0.0.0:4160",
+//	    "tombstone_lifetime": "45s",
+//	    "static_producers": [{"broadcast_address": "legacy-1", "tcp_port": 4150, "http_port": 4151,
+//	                          "version": "1.2.0", "topics": {"orders": ["archive"]}}]
+//	}
+func loadConfigFile(path string) (map[string]json.RawMessage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 把配置文件里的值写到opts里, 命令行里明确指定了的参数不会被覆盖
+// opts的字段通过flag tag和配置文件的key对应起来
+func resolveOptions(opts *nsqlookupd.Options, flagSet *flag.FlagSet, cfg map[string]json.RawMessage) error {
+	setOnCommandLine := make(map[string]bool)
+	flagSet.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	fields := make(map[string]reflect.Value)
+	collectOptionFields(reflect.ValueOf(opts).Elem(), fields)
+
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if setOnCommandLine[strings.Replace(key, "_", "-", -1)] {
+			continue
+		}
+		err := decodeOption(field, cfg[key])
+		if err != nil {
+			return fmt.Errorf("option %q - %s", key, err)
+		}
+	}
+	return nil
+}
+
+// 嵌入的结构体(ReloadableOptions)里的字段和外面的一样处理
+func collectOptionFields(val reflect.Value, fields map[string]reflect.Value) {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			collectOptionFields(val.Field(i), fields)
+			continue
+		}
+		name := field.Tag.Get("flag")
+		if name != "" {
+			fields[strings.Replace(name, "-", "_", -1)] = val.Field(i)
+		}
+	}
+}
+
+// 启动和热加载的时候都用这个, 命令行里明确指定了的参数优先于配置文件
+func applyConfigFile(opts *nsqlookupd.Options, flagSet *flag.FlagSet) error {
+	configFile := flagSet.Lookup("config").Value.String()
+	if configFile == "" {
+		return nil
+	}
+	cfg, err := loadConfigFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config file %s - %s", configFile, err)
+	}
+	err = resolveOptions(opts, flagSet, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config file %s - %s", configFile, err)
+	}
+	return nil
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	logLevelType = reflect.TypeOf(lg.LogLevel(0))
+)
+
+// time.Duration 和日志等级在配置文件里写字符串,比如 "45s" "debug", 其他的按json解析
+func decodeOption(field reflect.Value, raw json.RawMessage) error {
+	switch field.Type() {
+	case durationType:
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+	case logLevelType:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+		level, err := lg.ParseLogLevel(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(level))
+		return nil
+	}
+	return json.Unmarshal(raw, field.Addr().Interface())
+}
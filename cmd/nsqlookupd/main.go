@@ -0,0 +1,162 @@
+// nsqlookupd 可执行程序
+// 参数可以写在命令行里,也可以写在 -config 指定的json配置文件里,命令行参数优先
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/internal/version"
+	"github.com/xswwhy/nsq/nsqlookupd"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// 可以重复指定的flag, 直接写到Options的[]string字段里
+type stringArray []string
+
+func (a *stringArray) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *stringArray) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+// 日志等级的flag, 直接写到Options.LogLever里
+type logLevelValue lg.LogLevel
+
+func (l *logLevelValue) String() string {
+	return (*lg.LogLevel)(l).String()
+}
+
+func (l *logLevelValue) Set(s string) error {
+	level, err := lg.ParseLogLevel(s)
+	if err != nil {
+		return err
+	}
+	*l = logLevelValue(level)
+	return nil
+}
+
+// flag的名字和Options字段的flag tag一一对应, 配置文件里用同样的名字(-换成_)
+func nsqlookupdFlagSet(opts *nsqlookupd.Options) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("nsqlookupd", flag.ExitOnError)
+
+	flagSet.String("config", "", "path to config file")
+	flagSet.Bool("version", false, "print version string")
+
+	flagSet.Var((*logLevelValue)(&opts.LogLever), "log-level", "set log verbosity: debug, info, warn, error, or fatal")
+	flagSet.StringVar(&opts.LogPrefix, "log-prefix", opts.LogPrefix, "log message prefix")
+
+	flagSet.StringVar(&opts.TCPAddress, "tcp-address", opts.TCPAddress, "<addr>:<port> or unix://<path> to listen on for TCP clients")
+	flagSet.StringVar(&opts.HTTPAddress, "http-address", opts.HTTPAddress, "<addr>:<port> or unix://<path> to listen on for HTTP clients")
+	flagSet.StringVar(&opts.BroadcastAddress, "broadcast-address", opts.BroadcastAddress, "address of this lookupd node, (default to the OS hostname)")
+	flagSet.StringVar(&opts.UnixSocketMode, "unix-socket-mode", opts.UnixSocketMode, "octal file mode for unix socket listeners, e.g. 0660 (default: leave to umask)")
+	flagSet.Var((*stringArray)(&opts.ProxyProtocolTrustedCIDRs), "proxy-protocol-trusted-cidr", "CIDR or IP of a load balancer that must send a PROXY protocol v1/v2 header (may be given multiple times)")
+	flagSet.DurationVar(&opts.ProxyProtocolTimeout, "proxy-protocol-timeout", opts.ProxyProtocolTimeout, "timeout for reading the PROXY protocol header from a trusted source")
+
+	flagSet.DurationVar(&opts.InactiveProducerTimeout, "inactive-producer-timeout", opts.InactiveProducerTimeout, "duration of time a producer will remain in the active list since its last ping")
+	flagSet.DurationVar(&opts.TombstoneLifetime, "tombstone-lifetime", opts.TombstoneLifetime, "duration of time a producer will remain tombstoned if registration remains")
+
+	flagSet.IntVar(&opts.AuditLogSize, "audit-log-size", opts.AuditLogSize, "number of audit events kept in memory (0 to disable)")
+	flagSet.StringVar(&opts.AuditLogPath, "audit-log-path", opts.AuditLogPath, "path to append audit events to (empty to disable)")
+	flagSet.Int64Var(&opts.AuditLogMaxBytes, "audit-log-max-bytes", opts.AuditLogMaxBytes, "rotate the audit log file after this many bytes")
+	flagSet.IntVar(&opts.AuditLogMaxBackups, "audit-log-max-backups", opts.AuditLogMaxBackups, "number of rotated audit log files to keep")
+
+	flagSet.Var((*stringArray)(&opts.WebhookURLs), "webhook-url", "URL to POST registration events to (may be given multiple times)")
+	flagSet.Var((*stringArray)(&opts.WebhookEvents), "webhook-event", "event type to send to webhooks (may be given multiple times, default all)")
+	flagSet.IntVar(&opts.WebhookQueueSize, "webhook-queue-size", opts.WebhookQueueSize, "number of webhook events buffered per URL before dropping")
+	flagSet.IntVar(&opts.WebhookMaxRetries, "webhook-max-retries", opts.WebhookMaxRetries, "number of retries for a failed webhook delivery")
+	flagSet.DurationVar(&opts.WebhookTimeout, "webhook-timeout", opts.WebhookTimeout, "timeout for each webhook request")
+	flagSet.DurationVar(&opts.WebhookBackoff, "webhook-backoff", opts.WebhookBackoff, "initial backoff between webhook retries")
+
+	flagSet.DurationVar(&opts.HealthCheckInterval, "health-check-interval", opts.HealthCheckInterval, "interval between /ping probes of each producer's HTTP port (0 to disable); probes GET whatever broadcast_address:http_port a client sends in IDENTIFY, so only enable it when every client that can connect is trusted")
+	flagSet.DurationVar(&opts.HealthCheckTimeout, "health-check-timeout", opts.HealthCheckTimeout, "timeout for each health check probe")
+	flagSet.IntVar(&opts.HealthCheckFailureThreshold, "health-check-failure-threshold", opts.HealthCheckFailureThreshold, "consecutive failed probes before a producer is excluded from lookups")
+
+	flagSet.IntVar(&opts.MaxRegistrationsPerProducer, "max-registrations-per-producer", opts.MaxRegistrationsPerProducer, "max topics+channels a single nsqd may register (0 for unlimited)")
+	flagSet.IntVar(&opts.MaxChannelsPerTopic, "max-channels-per-topic", opts.MaxChannelsPerTopic, "max channels per topic (0 for unlimited)")
+	flagSet.IntVar(&opts.MaxRegistrations, "max-registrations", opts.MaxRegistrations, "max topics+channels in total (0 for unlimited)")
+	flagSet.IntVar(&opts.MaxRegistrationsPerNamespace, "max-registrations-per-namespace", opts.MaxRegistrationsPerNamespace, "max topics+channels per namespace (0 for unlimited)")
+
+	flagSet.IntVar(&opts.NameMaxLength, "name-max-length", opts.NameMaxLength, "max length of topic and channel names, including the #ephemeral suffix")
+	flagSet.StringVar(&opts.NamePattern, "name-pattern", opts.NamePattern, "regexp that topic and channel names (without the #ephemeral suffix) must match")
+	flagSet.Var((*stringArray)(&opts.ReservedNames), "reserved-name", "topic or channel name that may not be registered (may be given multiple times)")
+	flagSet.Var((*stringArray)(&opts.ReservedNamePrefixes), "reserved-name-prefix", "prefix of topic and channel names that may not be registered (may be given multiple times)")
+	flagSet.BoolVar(&opts.AllowEphemeralNames, "allow-ephemeral-names", opts.AllowEphemeralNames, "allow registering #ephemeral topics and channels")
+
+	flagSet.DurationVar(&opts.RegistrationReapInterval, "registration-reap-interval", opts.RegistrationReapInterval, "interval between checks for registrations whose TTL has expired")
+
+	flagSet.DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", opts.ShutdownTimeout, "max time to wait for in-flight commands on SIGINT/SIGTERM before closing all connections")
+	flagSet.DurationVar(&opts.ShutdownDrainDelay, "shutdown-drain-delay", opts.ShutdownDrainDelay, "time /ping reports DRAINING before the HTTP listener is closed")
+	flagSet.StringVar(&opts.ShutdownStatePath, "shutdown-state-path", opts.ShutdownStatePath, "path to save all registrations to on shutdown (empty to disable)")
+
+	return flagSet
+}
+
+func main() {
+	opts := nsqlookupd.NewOptions()
+	flagSet := nsqlookupdFlagSet(opts)
+	flagSet.Parse(os.Args[1:])
+
+	if flagSet.Lookup("version").Value.(flag.Getter).Get().(bool) {
+		fmt.Println(version.String("nsqlookupd"))
+		return
+	}
+
+	err := applyConfigFile(opts, flagSet)
+	if err != nil {
+		lg.LogFatal("[nsqlookupd] ", "%s", err)
+	}
+	// SIGHUP和POST /config/reload的时候重新读配置文件, 命令行参数还是启动时的
+	if flagSet.Lookup("config").Value.String() != "" {
+		opts.ConfigLoader = func() (*nsqlookupd.Options, error) {
+			reloaded := nsqlookupd.NewOptions()
+			reloadedFlagSet := nsqlookupdFlagSet(reloaded)
+			reloadedFlagSet.Parse(os.Args[1:])
+			return reloaded, applyConfigFile(reloaded, reloadedFlagSet)
+		}
+	}
+
+	l, err := nsqlookupd.New(opts)
+	if err != nil {
+		lg.LogFatal("[nsqlookupd] ", "failed to instantiate nsqlookupd - %s", err)
+	}
+
+	go func() {
+		err := l.Main()
+		if err != nil {
+			lg.LogFatal("[nsqlookupd] ", "%s", err)
+		}
+	}()
+
+	// 热加载的结果在nsqlookupd的日志里
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			l.ReloadConfig()
+		}
+	}()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+
+	// 再收到一次信号就不等了
+	ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+	go func() {
+		<-signalChan
+		cancel()
+	}()
+	err = l.Shutdown(ctx)
+	if err != nil {
+		lg.LogFatal("[nsqlookupd] ", "shutdown - %s", err)
+	}
+}
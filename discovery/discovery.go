@@ -0,0 +1,373 @@
+// discovery 是consumer那一侧用的服务发现
+// 定时从多个nsqlookupd的HTTP接口 /lookup 查询topic在哪些nsqd上,合并去重之后缓存在本地
+// 某个nsqlookupd挂了的时候,继续用它最后一次成功返回的结果,所以不会因为nsqlookupd挂了就找不到nsqd
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/http_api"
+	"github.com/xswwhy/nsq/internal/lg"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Logger lg.Logger
+
+// ErrNoLookupd 所有的nsqlookupd都没有成功返回过
+var ErrNoLookupd = errors.New("discovery: no lookupd responded")
+
+type Config struct {
+	LookupdHTTPAddrs []string // nsqlookupd的HTTP地址,比如 127.0.0.1:4161 或者 unix:///var/run/nsqlookupd-http.sock
+
+	PollInterval time.Duration
+	PollJitter   float64       // 每次poll的间隔在 PollInterval*(1±PollJitter) 之间随机,避免所有consumer同时请求
+	HTTPTimeout  time.Duration // 请求单个nsqlookupd的超时时间
+	MaxStaleness time.Duration // nsqlookupd挂了之后,它最后一次返回的结果最多还能用多久,0表示一直用
+
+	Selector string // 传给 /lookup 的label selector, 比如 env=prod
+
+	// 在哪个namespace里查找, 为空是默认namespace; namespace配置了ACL的话要带上Token
+	Namespace string
+	Token     string
+
+	Logger   Logger
+	LogLevel lg.LogLevel
+}
+
+func (c *Config) setDefaults() {
+	if c.PollInterval == 0 {
+		c.PollInterval = 60 * time.Second
+	}
+	if c.PollJitter == 0 {
+		c.PollJitter = 0.3
+	}
+	if c.HTTPTimeout == 0 {
+		c.HTTPTimeout = 2 * time.Second
+	}
+	if c.Logger == nil {
+		c.Logger = lg.NilLogger{}
+	}
+}
+
+// Producer nsqlookupd返回的nsqd信息
+type Producer struct {
+	RemoteAddress    string            `json:"remote_address"`
+	Hostname         string            `json:"hostname"`
+	BroadcastAddress string            `json:"broadcast_address"`
+	TCPPort          int               `json:"tcp_port"`
+	HTTPPort         int               `json:"http_port"`
+	Version          string            `json:"version"`
+	Labels           map[string]string `json:"labels,omitempty"`
+}
+
+// Addr 去重用的key, 同一个nsqd在不同nsqlookupd上的RemoteAddress可能不一样,所以用broadcast地址+tcp端口
+func (p Producer) Addr() string {
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort))
+}
+
+// ChangeFunc topic的producer有变化的时候回调, added removed 至少有一个不为空
+type ChangeFunc func(topic string, added []Producer, removed []Producer)
+
+// 某个nsqlookupd对某个topic最后一次成功的返回
+type lookupResult struct {
+	producers []Producer
+	updatedAt time.Time
+}
+
+type topicState struct {
+	results   map[string]*lookupResult // nsqlookupd地址 -> 结果
+	producers map[string]Producer      // 合并去重之后的, Producer.Addr() -> Producer
+}
+
+type lookupdEndpoint struct {
+	client *http.Client
+	base   string // http://host:port
+}
+
+type Discoverer struct {
+	sync.RWMutex
+	cfg      Config
+	lookupds map[string]lookupdEndpoint // LookupdHTTPAddrs中的地址 -> 请求用的client和url前缀
+	topics   map[string]*topicState
+	handlers []ChangeFunc
+
+	// 合并结果到调用完回调之间一直持有, 并发Refresh的时候回调的顺序和缓存变化的顺序一样
+	notifyLock sync.Mutex
+
+	rng      *rand.Rand
+	exitChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func New(cfg Config) (*Discoverer, error) {
+	cfg.setDefaults()
+	if len(cfg.LookupdHTTPAddrs) == 0 {
+		return nil, errors.New("discovery: no lookupd HTTP addresses")
+	}
+	if cfg.PollJitter < 0 || cfg.PollJitter >= 1 {
+		return nil, fmt.Errorf("discovery: invalid poll jitter %v", cfg.PollJitter)
+	}
+	// unix socket的地址每个都要单独的http.Client
+	lookupds := make(map[string]lookupdEndpoint, len(cfg.LookupdHTTPAddrs))
+	for _, addr := range cfg.LookupdHTTPAddrs {
+		client, base := http_api.NewClient(addr, cfg.HTTPTimeout)
+		lookupds[addr] = lookupdEndpoint{client, base}
+	}
+	return &Discoverer{
+		cfg:      cfg,
+		lookupds: lookupds,
+		topics:   make(map[string]*topicState),
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		exitChan: make(chan struct{}),
+	}, nil
+}
+
+// OnChange 注册变化回调, 回调是在poll的goroutine里面调用的
+// 同一时间只会有一个回调在执行, 回调里不能调用Poll和Refresh
+func (d *Discoverer) OnChange(fn ChangeFunc) {
+	d.Lock()
+	defer d.Unlock()
+	d.handlers = append(d.handlers, fn)
+}
+
+// Watch 开始关注一个topic, 下一次poll的时候会查询它
+func (d *Discoverer) Watch(topic string) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.topics[topic]; !ok {
+		d.topics[topic] = &topicState{
+			results:   make(map[string]*lookupResult),
+			producers: make(map[string]Producer),
+		}
+	}
+}
+
+// Unwatch 不再关注这个topic, 缓存也一起删掉
+func (d *Discoverer) Unwatch(topic string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.topics, topic)
+}
+
+// Producers 返回缓存中topic的producer,按Addr()排序
+func (d *Discoverer) Producers(topic string) []Producer {
+	d.RLock()
+	defer d.RUnlock()
+	state, ok := d.topics[topic]
+	if !ok {
+		return nil
+	}
+	return sortedProducers(state.producers)
+}
+
+// Start 开始定时poll, 开始之前先同步poll一次
+func (d *Discoverer) Start() {
+	d.Poll()
+	d.wg.Add(1)
+	go d.loop()
+}
+
+// Stop 可以调用多次
+func (d *Discoverer) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.exitChan)
+	})
+	d.wg.Wait()
+}
+
+func (d *Discoverer) loop() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-time.After(d.nextInterval()):
+			d.Poll()
+		case <-d.exitChan:
+			return
+		}
+	}
+}
+
+// PollInterval*(1±PollJitter) 之间随机
+func (d *Discoverer) nextInterval() time.Duration {
+	d.Lock()
+	jitter := (d.rng.Float64()*2 - 1) * d.cfg.PollJitter
+	d.Unlock()
+	return time.Duration(float64(d.cfg.PollInterval) * (1 + jitter))
+}
+
+// Poll 马上查询所有关注的topic
+func (d *Discoverer) Poll() {
+	d.RLock()
+	topics := make([]string, 0, len(d.topics))
+	for t := range d.topics {
+		topics = append(topics, t)
+	}
+	d.RUnlock()
+
+	for _, t := range topics {
+		err := d.Refresh(t)
+		if err != nil {
+			d.logf(lg.WARN, "DISCOVERY: refresh topic(%s) failed - %s", t, err)
+		}
+	}
+}
+
+// Refresh 马上查询一个topic, 所有nsqlookupd都失败并且没有可用的缓存的时候返回ErrNoLookupd
+func (d *Discoverer) Refresh(topic string) error {
+	d.Watch(topic)
+
+	// 并发请求所有nsqlookupd
+	type response struct {
+		addr      string
+		producers []Producer
+		err       error
+	}
+	responses := make(chan response, len(d.cfg.LookupdHTTPAddrs))
+	for _, addr := range d.cfg.LookupdHTTPAddrs {
+		go func(addr string) {
+			producers, err := d.lookup(addr, topic)
+			responses <- response{addr, producers, err}
+		}(addr)
+	}
+
+	// 等所有请求都返回了再加锁,不然查缓存的人要一直等着
+	results := make(map[string][]Producer)
+	for range d.cfg.LookupdHTTPAddrs {
+		resp := <-responses
+		if resp.err != nil {
+			d.logf(lg.WARN, "DISCOVERY: lookupd(%s) topic(%s) - %s", resp.addr, topic, resp.err)
+			continue
+		}
+		results[resp.addr] = resp.producers
+	}
+
+	d.notifyLock.Lock()
+	defer d.notifyLock.Unlock()
+	now := time.Now()
+	d.Lock()
+	state, ok := d.topics[topic]
+	if !ok {
+		// 请求的时候被Unwatch了
+		d.Unlock()
+		return nil
+	}
+	for addr, producers := range results {
+		state.results[addr] = &lookupResult{producers: producers, updatedAt: now}
+	}
+
+	// 合并所有nsqlookupd的结果, 太久没更新的结果不要了
+	merged := make(map[string]Producer)
+	usable := 0
+	for addr, result := range state.results {
+		if d.cfg.MaxStaleness > 0 && now.Sub(result.updatedAt) > d.cfg.MaxStaleness {
+			delete(state.results, addr)
+			continue
+		}
+		usable++
+		for _, p := range result.producers {
+			merged[p.Addr()] = p
+		}
+	}
+	if usable == 0 {
+		d.Unlock()
+		return ErrNoLookupd
+	}
+
+	var added, removed []Producer
+	for k, p := range merged {
+		if _, ok := state.producers[k]; !ok {
+			added = append(added, p)
+		}
+	}
+	for k, p := range state.producers {
+		if _, ok := merged[k]; !ok {
+			removed = append(removed, p)
+		}
+	}
+	state.producers = merged
+	handlers := d.handlers
+	d.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	sortProducers(added)
+	sortProducers(removed)
+	for _, fn := range handlers {
+		fn(topic, added, removed)
+	}
+	return nil
+}
+
+// 请求一个nsqlookupd的 /lookup, topic不存在(404)算是成功,返回空
+func (d *Discoverer) lookup(addr string, topic string) ([]Producer, error) {
+	lookupd := d.lookupds[addr]
+	query := url.Values{}
+	query.Set("topic", topic)
+	if d.cfg.Selector != "" {
+		query.Set("selector", d.cfg.Selector)
+	}
+	if d.cfg.Namespace != "" {
+		query.Set("namespace", d.cfg.Namespace)
+	}
+	req, err := http.NewRequest("GET", lookupd.base+"/lookup?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.cfg.Token)
+	}
+	resp, err := lookupd.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return []Producer{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got response %s %q", resp.Status, body)
+	}
+
+	var data struct {
+		Producers []Producer `json:"producers"`
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Producers, nil
+}
+
+func (d *Discoverer) logf(level lg.LogLevel, f string, args ...interface{}) {
+	lg.Logf(d.cfg.Logger, d.cfg.LogLevel, level, f, args...)
+}
+
+func sortedProducers(pm map[string]Producer) []Producer {
+	producers := make([]Producer, 0, len(pm))
+	for _, p := range pm {
+		producers = append(producers, p)
+	}
+	sortProducers(producers)
+	return producers
+}
+
+func sortProducers(producers []Producer) {
+	sort.Slice(producers, func(i, j int) bool {
+		return producers[i].Addr() < producers[j].Addr()
+	})
+}
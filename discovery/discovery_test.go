@@ -0,0 +1,278 @@
+package discovery_test
+
+import (
+	"encoding/json"
+	"github.com/xswwhy/nsq/discovery"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 假的nsqlookupd, 只实现了 /lookup
+type fakeLookupd struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	producers map[string][]discovery.Producer // topic -> producer, 没有的topic返回404
+	down      bool
+	requests  int32
+}
+
+func newFakeLookupd(t *testing.T) *fakeLookupd {
+	f := &fakeLookupd{producers: make(map[string][]discovery.Producer)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.lookup))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeLookupd) lookup(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&f.requests, 1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	producers, ok := f.producers[req.URL.Query().Get("topic")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"TOPIC_NOT_FOUND"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"channels":  []string{},
+		"producers": producers,
+	})
+}
+
+func (f *fakeLookupd) set(topic string, producers ...discovery.Producer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.producers[topic] = producers
+}
+
+func (f *fakeLookupd) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func producer(addr string, port int) discovery.Producer {
+	return discovery.Producer{
+		RemoteAddress:    addr + ":40000",
+		BroadcastAddress: addr,
+		TCPPort:          port,
+		HTTPPort:         port + 1,
+	}
+}
+
+func newDiscoverer(t *testing.T, lookupds []*fakeLookupd, configure ...func(*discovery.Config)) *discovery.Discoverer {
+	cfg := discovery.Config{HTTPTimeout: time.Second}
+	for _, l := range lookupds {
+		cfg.LookupdHTTPAddrs = append(cfg.LookupdHTTPAddrs, l.URL)
+	}
+	for _, fn := range configure {
+		fn(&cfg)
+	}
+	d, err := discovery.New(cfg)
+	if err != nil {
+		t.Fatalf("New failed - %s", err)
+	}
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func assertAddrs(t *testing.T, what string, producers []discovery.Producer, want ...string) {
+	t.Helper()
+	var got []string
+	for _, p := range producers {
+		got = append(got, p.Addr())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%s: expected %v, got %v", what, want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: expected %v, got %v", what, want, got)
+		}
+	}
+}
+
+// 同一个nsqd在不同的nsqlookupd上RemoteAddress不一样, 按broadcast地址和tcp端口去重
+func TestMergeDedup(t *testing.T) {
+	l1, l2, l3 := newFakeLookupd(t), newFakeLookupd(t), newFakeLookupd(t)
+	l1.set("orders", producer("10.0.0.1", 4150), producer("10.0.0.2", 4150))
+	b := producer("10.0.0.2", 4150)
+	b.RemoteAddress = "10.0.0.2:50000"
+	l2.set("orders", b, producer("10.0.0.3", 4150))
+	// l3上没有这个topic, 404算是成功返回了空
+
+	d := newDiscoverer(t, []*fakeLookupd{l1, l2, l3})
+	var calls int
+	d.OnChange(func(topic string, added []discovery.Producer, removed []discovery.Producer) {
+		calls++
+		if topic != "orders" {
+			t.Errorf("unexpected topic %s", topic)
+		}
+		assertAddrs(t, "added", added, "10.0.0.1:4150", "10.0.0.2:4150", "10.0.0.3:4150")
+		assertAddrs(t, "removed", removed)
+	})
+	err := d.Refresh("orders")
+	if err != nil {
+		t.Fatalf("Refresh failed - %s", err)
+	}
+	assertAddrs(t, "producers", d.Producers("orders"), "10.0.0.1:4150", "10.0.0.2:4150", "10.0.0.3:4150")
+
+	// 结果没变化的时候不回调
+	err = d.Refresh("orders")
+	if err != nil {
+		t.Fatalf("Refresh failed - %s", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 callback, got %d", calls)
+	}
+}
+
+func TestKeepLastGoodResult(t *testing.T) {
+	l1, l2 := newFakeLookupd(t), newFakeLookupd(t)
+	l1.set("orders", producer("10.0.0.1", 4150))
+	l2.set("orders", producer("10.0.0.2", 4150))
+	d := newDiscoverer(t, []*fakeLookupd{l1, l2}, func(cfg *discovery.Config) {
+		cfg.MaxStaleness = 200 * time.Millisecond
+	})
+	var removed []discovery.Producer
+	d.OnChange(func(topic string, a []discovery.Producer, r []discovery.Producer) {
+		removed = append(removed, r...)
+	})
+	err := d.Refresh("orders")
+	if err != nil {
+		t.Fatalf("Refresh failed - %s", err)
+	}
+
+	// l2挂了, 继续用它最后一次返回的结果
+	l2.setDown(true)
+	err = d.Refresh("orders")
+	if err != nil {
+		t.Fatalf("Refresh failed - %s", err)
+	}
+	assertAddrs(t, "producers", d.Producers("orders"), "10.0.0.1:4150", "10.0.0.2:4150")
+	assertAddrs(t, "removed", removed)
+
+	// 超过MaxStaleness之后l2的结果就不要了
+	time.Sleep(300 * time.Millisecond)
+	err = d.Refresh("orders")
+	if err != nil {
+		t.Fatalf("Refresh failed - %s", err)
+	}
+	assertAddrs(t, "producers", d.Producers("orders"), "10.0.0.1:4150")
+	assertAddrs(t, "removed", removed, "10.0.0.2:4150")
+
+	// l2恢复了
+	l2.setDown(false)
+	err = d.Refresh("orders")
+	if err != nil {
+		t.Fatalf("Refresh failed - %s", err)
+	}
+	assertAddrs(t, "producers", d.Producers("orders"), "10.0.0.1:4150", "10.0.0.2:4150")
+
+	// 所有nsqlookupd都挂了, 也没有缓存
+	l1.setDown(true)
+	l2.setDown(true)
+	err = d.Refresh("events")
+	if err != discovery.ErrNoLookupd {
+		t.Fatalf("expected ErrNoLookupd, got %v", err)
+	}
+}
+
+// 并发Refresh的时候, 按回调的顺序把added removed应用到一个集合上, 每一步都要说得通, 最后和缓存一样
+func TestConcurrentRefreshCallbackOrder(t *testing.T) {
+	l1, l2 := newFakeLookupd(t), newFakeLookupd(t)
+	l1.set("orders", producer("10.0.0.1", 4150))
+	l2.set("orders")
+	d := newDiscoverer(t, []*fakeLookupd{l1, l2})
+
+	var mu sync.Mutex
+	var running int32
+	seen := make(map[string]bool)
+	d.OnChange(func(topic string, added []discovery.Producer, removed []discovery.Producer) {
+		if atomic.AddInt32(&running, 1) > 1 {
+			t.Errorf("callbacks run concurrently")
+		}
+		defer atomic.AddInt32(&running, -1)
+		// 慢一点的回调, 让后面的Refresh有机会插进来
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range removed {
+			if !seen[p.Addr()] {
+				t.Errorf("removed %s before it was added", p.Addr())
+			}
+			delete(seen, p.Addr())
+		}
+		for _, p := range added {
+			if seen[p.Addr()] {
+				t.Errorf("added %s twice", p.Addr())
+			}
+			seen[p.Addr()] = true
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				// l2上的producer一会儿有一会儿没有
+				if (i+j)%2 == 0 {
+					l2.set("orders", producer("10.0.0.2", 4150))
+				} else {
+					l2.set("orders")
+				}
+				if i%2 == 0 {
+					d.Refresh("orders")
+				} else {
+					d.Poll()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	producers := d.Producers("orders")
+	if len(producers) != len(seen) {
+		t.Fatalf("callbacks describe %v, cache has %v", seen, producers)
+	}
+	for _, p := range producers {
+		if !seen[p.Addr()] {
+			t.Fatalf("callbacks describe %v, cache has %v", seen, producers)
+		}
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	l := newFakeLookupd(t)
+	l.set("orders", producer("10.0.0.1", 4150))
+	d := newDiscoverer(t, []*fakeLookupd{l}, func(cfg *discovery.Config) {
+		cfg.PollInterval = 10 * time.Millisecond
+	})
+	d.Watch("orders")
+	d.Start()
+	assertAddrs(t, "producers", d.Producers("orders"), "10.0.0.1:4150")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&l.requests) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("discoverer did not poll")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 多次Stop不会panic, t.Cleanup里还会再Stop一次
+	d.Stop()
+	d.Stop()
+}
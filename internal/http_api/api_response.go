@@ -0,0 +1,96 @@
+package http_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/lg"
+	"net/http"
+	"time"
+)
+
+// Err 带HTTP状态码的错误, Text 会原样返回给调用方
+// Reason 是给人看的具体原因, 不为空的时候和message一起返回, Text还是保持固定的错误码
+type Err struct {
+	Code   int
+	Text   string
+	Reason string
+}
+
+func (e Err) Error() string {
+	return e.Text
+}
+
+// APIHandler 业务处理函数只需要返回数据或者错误,怎么写回response交给V1()
+type APIHandler func(w http.ResponseWriter, req *http.Request) (interface{}, error)
+
+// V1 把APIHandler包装成http.HandlerFunc
+// 正常返回: 200 + json数据
+// 出错返回: Err.Code + {"message": Err.Text, "reason": Err.Reason}
+func V1(f APIHandler, logf lg.AppLogFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		data, err := f(w, req)
+		code := 200
+		if err != nil {
+			code = 500
+			reason := ""
+			if e, ok := err.(Err); ok {
+				code = e.Code
+				reason = e.Reason
+			}
+			data = struct {
+				Message string `json:"message"`
+				Reason  string `json:"reason,omitempty"`
+			}{err.Error(), reason}
+		}
+		RespondV1(w, code, data)
+		logf(lg.DEBUG, "%d %s %s (%s) %s", code, req.Method, req.URL.RequestURI(), req.RemoteAddr, time.Since(start))
+	}
+}
+
+// PlainText 直接返回字符串,比如 /ping 的 OK
+func PlainText(f APIHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := f(w, req)
+		code := 200
+		if err != nil {
+			code = 500
+			if e, ok := err.(Err); ok {
+				code = e.Code
+			}
+			data = err.Error()
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprint(w, data)
+	}
+}
+
+// Methods 限制请求方法,不支持的方法返回405
+func Methods(f APIHandler, methods ...string) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+		for _, m := range methods {
+			if req.Method == m {
+				return f(w, req)
+			}
+		}
+		return nil, Err{Code: 405, Text: "METHOD_NOT_ALLOWED"}
+	}
+}
+
+func RespondV1(w http.ResponseWriter, code int, data interface{}) {
+	var response []byte
+	var err error
+	if data == nil {
+		response = []byte("{}")
+	} else {
+		response, err = json.Marshal(data)
+		if err != nil {
+			code = 500
+			response = []byte(`{"message": "INTERNAL_ERROR"}`)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(response)
+}
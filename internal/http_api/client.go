@@ -0,0 +1,30 @@
+package http_api
+
+import (
+	"context"
+	"github.com/xswwhy/nsq/internal/util"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NewClient 返回请求addr用的http.Client和url前缀
+// addr可以是 host:port, http(s)://host:port, 或者 unix:///path/to.sock
+// unix socket的请求都发给这一个socket, url里的host没有意义, 固定写成unix
+func NewClient(addr string, timeout time.Duration) (*http.Client, string) {
+	if util.IsUnixAddress(addr) {
+		_, path := util.ParseAddress(addr)
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return &http.Client{Timeout: timeout, Transport: transport}, "http://unix"
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &http.Client{Timeout: timeout}, addr
+}
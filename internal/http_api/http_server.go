@@ -0,0 +1,30 @@
+package http_api
+
+import (
+	"fmt"
+	"github.com/xswwhy/nsq/internal/lg"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Serve 和protocol.TCPServer 差不多,作为HTTP服务的启动入口
+// proto 只是为了日志里面区分是HTTP还是HTTPS
+func Serve(listener net.Listener, handler http.Handler, proto string, logf lg.AppLogFunc) error {
+	return ServeServer(&http.Server{Handler: handler}, listener, proto, logf)
+}
+
+// ServeServer 用调用方创建的http.Server
+// 只关listener的话keep-alive的连接还会一直在, 要用server.Shutdown()或者server.Close()才能断开
+func ServeServer(server *http.Server, listener net.Listener, proto string, logf lg.AppLogFunc) error {
+	logf(lg.INFO, "%s: listening on %s", proto, listener.Addr())
+
+	err := server.Serve(listener)
+	// listener被Close()之后Serve()会返回 use of closed network connection, 这个不算错误
+	if err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "use of closed network connection") {
+		return fmt.Errorf("http.Serve() error - %s", err)
+	}
+
+	logf(lg.INFO, "%s: closing %s", proto, listener.Addr())
+	return nil
+}
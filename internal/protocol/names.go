@@ -1,22 +1,119 @@
 package protocol
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
 // TopicName  ChannelName 都要遵守命名规则
 // 后面要是出现 #ephemeral 表示要连Registration(map中的key)一起删除
-var validTopicChannelNameRegex = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+const EphemeralSuffix = "#ephemeral"
 
-func IsValidTopicName(name string) bool {
-	return isValidName(name)
+// 默认的命名规则, 和以前写死的一样: 最长64个字符, 只能有 . a-z A-Z 0-9 _ -
+const (
+	DefaultNameMaxLength = 64
+	DefaultNamePattern   = `^[\.a-zA-Z0-9_-]+$`
+)
+
+var DefaultNamePolicy = mustNamePolicy(DefaultNameMaxLength, DefaultNamePattern, nil, nil, true)
+
+// NamePolicy topic和channel的命名规则
+type NamePolicy struct {
+	maxLength        int            // 包括#ephemeral后缀
+	pattern          *regexp.Regexp // 去掉#ephemeral后缀之后要匹配
+	reservedNames    map[string]bool
+	reservedPrefixes []string
+	allowEphemeral   bool
 }
 
-func IsValidChannelName(name string) bool {
-	return isValidName(name)
+// NameError 名字不合法的具体原因
+type NameError struct {
+	Name   string
+	Reason string
 }
 
-func isValidName(name string) bool {
-	if len(name) > 64 || len(name) < 1 {
-		return false
+func (e *NameError) Error() string {
+	return e.Reason
+}
+
+func NewNamePolicy(maxLength int, pattern string, reservedNames []string, reservedPrefixes []string, allowEphemeral bool) (*NamePolicy, error) {
+	if maxLength < 1 {
+		return nil, fmt.Errorf("invalid name max length %d", maxLength)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name pattern %q - %s", pattern, err)
+	}
+	p := &NamePolicy{
+		maxLength:        maxLength,
+		pattern:          re,
+		reservedNames:    make(map[string]bool),
+		reservedPrefixes: reservedPrefixes,
+		allowEphemeral:   allowEphemeral,
+	}
+	for _, name := range reservedNames {
+		p.reservedNames[name] = true
 	}
-	return validTopicChannelNameRegex.MatchString(name)
+	return p, nil
+}
+
+func mustNamePolicy(maxLength int, pattern string, reservedNames []string, reservedPrefixes []string, allowEphemeral bool) *NamePolicy {
+	p, err := NewNamePolicy(maxLength, pattern, reservedNames, reservedPrefixes, allowEphemeral)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ValidateTopicName 新建topic的时候用, 检查所有的规则
+func (p *NamePolicy) ValidateTopicName(name string) error {
+	return p.validate(name, true)
+}
+
+// ValidateChannelName 新建channel的时候用, 检查所有的规则
+func (p *NamePolicy) ValidateChannelName(name string) error {
+	return p.validate(name, true)
+}
+
+// ValidateSyntax 只检查长度和字符, 不检查保留名字和#ephemeral
+// 查询和删除已有的topic/channel的时候用, 规则改了之后以前注册的名字还能删掉
+func (p *NamePolicy) ValidateSyntax(name string) error {
+	return p.validate(name, false)
+}
+
+func (p *NamePolicy) validate(name string, creating bool) error {
+	if len(name) < 1 {
+		return &NameError{name, "name is empty"}
+	}
+	if len(name) > p.maxLength {
+		return &NameError{name, fmt.Sprintf("name is longer than %d characters", p.maxLength)}
+	}
+	base := strings.TrimSuffix(name, EphemeralSuffix)
+	if !p.pattern.MatchString(base) {
+		return &NameError{name, fmt.Sprintf("name does not match pattern %s", p.pattern)}
+	}
+	if !creating {
+		return nil
+	}
+	if base != name && !p.allowEphemeral {
+		return &NameError{name, "ephemeral names are not allowed"}
+	}
+	if p.reservedNames[base] {
+		return &NameError{name, "name is reserved"}
+	}
+	for _, prefix := range p.reservedPrefixes {
+		if strings.HasPrefix(base, prefix) {
+			return &NameError{name, fmt.Sprintf("name has reserved prefix %q", prefix)}
+		}
+	}
+	return nil
+}
+
+func IsValidTopicName(name string) bool {
+	return DefaultNamePolicy.ValidateTopicName(name) == nil
+}
+
+func IsValidChannelName(name string) bool {
+	return DefaultNamePolicy.ValidateChannelName(name) == nil
 }
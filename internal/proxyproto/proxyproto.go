@@ -0,0 +1,270 @@
+// proxyproto 解析HAProxy的PROXY protocol v1/v2 头
+// nsqlookupd在四层负载均衡后面的时候, 连接的RemoteAddr是负载均衡的地址, 所有nsqd的id就都一样了
+// 负载均衡在连接的最前面加上一个头告诉我们真实的客户端地址
+// 只有来自信任的地址的连接才解析, 而且必须带头; 其他的连接原样返回, 防止客户端伪造地址
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2的头以这12个字节开头
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // 规范里规定的最大长度, 包括\r\n
+)
+
+var ErrNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+
+// ParseCIDRs 解析信任的地址列表, 单个ip也可以, 当成/32或者/128
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted CIDR %q - %s", s, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Listener 包装一个net.Listener, 信任的地址来的连接要先读PROXY头
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration // 读PROXY头最多等多久
+}
+
+func NewListener(listener net.Listener, trusted []*net.IPNet, timeout time.Duration) *Listener {
+	return &Listener{
+		Listener: listener,
+		trusted:  trusted,
+		timeout:  timeout,
+	}
+}
+
+// Accept 不在这里读头, 不然一个慢的连接会卡住所有的Accept
+// 第一次Read或者RemoteAddr的时候才读, 这两个都是在处理连接的goroutine里调用的
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.timeout,
+	}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn RemoteAddr返回PROXY头里的客户端地址
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error    // 读头失败了, 之后的Read都返回这个错误
+	remoteAddr net.Addr // 为nil表示头里没有地址(LOCAL或者UNKNOWN), 用连接本身的地址
+
+	deadlineLock sync.Mutex
+	readDeadline time.Time // 调用方设置的读超时, 读完头之后恢复成这个
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) readHeader() {
+	if c.timeout > 0 {
+		// 调用方设置的超时更早的话用调用方的, 读完头再恢复, 不能直接清掉
+		c.deadlineLock.Lock()
+		deadline := time.Now().Add(c.timeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.deadlineLock.Unlock()
+		defer func() {
+			c.deadlineLock.Lock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+			c.deadlineLock.Unlock()
+		}()
+	}
+	c.remoteAddr, c.err = ReadHeader(c.reader)
+}
+
+// ReadHeader 读取v1或者v2的头, 返回客户端地址
+// LOCAL命令(负载均衡自己的健康检查)和不认识的协议返回nil
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte(v1Prefix)) {
+		return nil, ErrNoHeader
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("proxyproto: v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source address %q", fields[2])
+	}
+	if (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("proxyproto: v1 source address %q does not match %s", fields[2], fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// 12字节签名 + 版本和命令 + 地址族和协议 + 2字节长度 + 地址
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], v2Signature) {
+		return nil, ErrNoHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported v2 command %d", command)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("proxyproto: v2 IPv4 address block too short")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("proxyproto: v2 IPv6 address block too short")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	// UDP unix socket之类的, 地址没法用, 用连接本身的地址
+	return nil, nil
+}
@@ -0,0 +1,218 @@
+package proxyproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func v2Header(command byte, family byte, payload []byte) []byte {
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+func v2IPv4(src string, srcPort uint16) []byte {
+	b := make([]byte, 12)
+	copy(b[0:4], net.ParseIP(src).To4())
+	copy(b[4:8], net.ParseIP("10.0.0.2").To4())
+	binary.BigEndian.PutUint16(b[8:10], srcPort)
+	binary.BigEndian.PutUint16(b[10:12], 4160)
+	return b
+}
+
+func v2IPv6(src string, srcPort uint16) []byte {
+	b := make([]byte, 36)
+	copy(b[0:16], net.ParseIP(src).To16())
+	copy(b[16:32], net.ParseIP("2001:db8::2").To16())
+	binary.BigEndian.PutUint16(b[32:34], srcPort)
+	binary.BigEndian.PutUint16(b[34:36], 4160)
+	return b
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		addr   string // 为空表示没有地址
+		hasErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160\r\n", "192.168.0.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 4160\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 unknown with addresses", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n", "", true},
+		{"v1 not terminated", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160", "", true},
+		{"v1 missing CR", "PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160\n", "", true},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 4160\r\n", "", true},
+		{"v1 missing fields", "PROXY TCP4 192.168.0.1 56324\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.168.0.1 192.168.0.11 99999 4160\r\n", "", true},
+		{"v2 proxy ipv4", string(v2Header(0x1, 0x11, v2IPv4("10.0.0.1", 1234))), "10.0.0.1:1234", false},
+		{"v2 proxy ipv6", string(v2Header(0x1, 0x21, v2IPv6("2001:db8::1", 1234))), "[2001:db8::1]:1234", false},
+		{"v2 proxy ipv4 with tlvs", string(v2Header(0x1, 0x11, append(v2IPv4("10.0.0.1", 1234), 0x04, 0, 0))), "10.0.0.1:1234", false},
+		{"v2 proxy udp", string(v2Header(0x1, 0x12, v2IPv4("10.0.0.1", 1234))), "", false},
+		{"v2 local", string(v2Header(0x0, 0x00, nil)), "", false},
+		{"v2 local with addresses", string(v2Header(0x0, 0x11, v2IPv4("10.0.0.1", 1234))), "", false},
+		{"v2 ipv4 block too short", string(v2Header(0x1, 0x11, make([]byte, 8))), "", true},
+		{"v2 ipv6 block too short", string(v2Header(0x1, 0x21, make([]byte, 20))), "", true},
+		{"v2 truncated payload", string(v2Header(0x1, 0x11, v2IPv4("10.0.0.1", 1234))[:20]), "", true},
+		{"v2 truncated header", string(v2Signature) + "\x21", "", true},
+		{"v2 bad version", string(append(v2Signature, 0x11, 0x11, 0, 0)), "", true},
+		{"v2 bad command", string(v2Header(0x2, 0x11, v2IPv4("10.0.0.1", 1234))), "", true},
+		{"no header", "  V1IDENTIFY\n", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 头后面的数据要原样留在reader里
+			r := bufio.NewReader(strings.NewReader(tt.input + "PING\n"))
+			addr, err := ReadHeader(r)
+			if tt.hasErr {
+				if err == nil {
+					t.Fatalf("expected error, got addr %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadHeader failed - %s", err)
+			}
+			if tt.addr == "" && addr != nil {
+				t.Fatalf("expected no address, got %s", addr)
+			}
+			if tt.addr != "" && (addr == nil || addr.String() != tt.addr) {
+				t.Fatalf("expected address %s, got %v", tt.addr, addr)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "PING\n" {
+				t.Fatalf("expected PING after the header, got %q", rest)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	header := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160\r\n"
+	tests := []struct {
+		name    string
+		trusted string
+		input   string
+		addr    string // 为空表示连接本身的地址
+		data    string
+		hasErr  bool
+	}{
+		{"trusted with header", "127.0.0.1", header + "PING\n", "192.168.0.1:56324", "PING\n", false},
+		{"trusted local", "127.0.0.0/8", "PROXY UNKNOWN\r\nPING\n", "", "PING\n", false},
+		{"trusted without header", "127.0.0.1", "PING\n", "", "", true},
+		// 不信任的地址来的头不解析, 当成普通数据交给协议处理, 地址也不会被伪造
+		{"untrusted with header", "10.0.0.0/8", header + "PING\n", "", header + "PING\n", false},
+		{"untrusted without header", "10.0.0.0/8", "PING\n", "", "PING\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := accept(t, tt.trusted, time.Second)
+			client.Write([]byte(tt.input))
+			client.Close()
+
+			data, err := io.ReadAll(conn)
+			if tt.hasErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read failed - %s", err)
+			}
+			if string(data) != tt.data {
+				t.Fatalf("expected data %q, got %q", tt.data, data)
+			}
+			addr := tt.addr
+			if addr == "" {
+				addr = client.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != addr {
+				t.Fatalf("expected remote address %s, got %s", addr, conn.RemoteAddr())
+			}
+		})
+	}
+}
+
+// 读头的超时不能覆盖调用方设置的超时
+func TestReadDeadline(t *testing.T) {
+	header := "PROXY TCP4 192.168.0.1 192.168.0.11 56324 4160\r\n"
+
+	// 调用方的超时比读头的超时短, 读完头之后还要生效
+	conn, client := accept(t, "127.0.0.1", 10*time.Second)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	client.Write([]byte(header))
+	_, err := readWithin(t, conn, 5*time.Second)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected timeout from the caller's deadline, got %v", err)
+	}
+
+	// 调用方没有设置超时, 读完头之后不能还用读头的超时
+	conn, client = accept(t, "127.0.0.1", 50*time.Millisecond)
+	client.Write([]byte(header))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		client.Write([]byte("PING\n"))
+	}()
+	line, err := readWithin(t, conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Read after the header timeout failed - %s", err)
+	}
+	if line != "PING\n" {
+		t.Fatalf("expected PING, got %q", line)
+	}
+}
+
+func accept(t *testing.T, trusted string, timeout time.Duration) (net.Conn, net.Conn) {
+	nets, err := ParseCIDRs([]string{trusted})
+	if err != nil {
+		t.Fatalf("ParseCIDRs failed - %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %s", err)
+	}
+	l := NewListener(ln, nets, timeout)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial - %s", err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed - %s", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return conn, client
+}
+
+// 读一行, 超时没返回就是读头的时候把超时弄丢了
+func readWithin(t *testing.T, conn net.Conn, timeout time.Duration) (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		ch <- result{line, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.line, r.err
+	case <-time.After(timeout):
+		t.Fatalf("Read did not return within %s", timeout)
+	}
+	return "", nil
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// 地址写成 unix:///path/to.sock 表示unix socket, 其他的都是TCP的 host:port
+const UnixPrefix = "unix://"
+
+// ParseAddress 返回net.Listen net.Dial用的network和address
+func ParseAddress(addr string) (string, string) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return "unix", strings.TrimPrefix(addr, UnixPrefix)
+	}
+	return "tcp", addr
+}
+
+func IsUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, UnixPrefix)
+}
+
+// Listen 支持unix://地址
+// 进程被kill掉的时候socket文件不会被删掉, 再监听就会报address already in use
+// 所以监听之前先连一下, 连不上说明是以前留下来的, 删掉; 连得上说明真的有别人在用
+func Listen(addr string) (net.Listener, error) {
+	network, address := ParseAddress(addr)
+	if network == "unix" {
+		if address == "" {
+			return nil, fmt.Errorf("empty unix socket path")
+		}
+		err := removeStaleSocket(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// AddrString 和Listen的地址格式一样, unix socket带上unix://前缀
+func AddrString(addr net.Addr) string {
+	if addr.Network() == "unix" {
+		return UnixPrefix + addr.String()
+	}
+	return addr.String()
+}
+
+// AddrPort TCP地址的端口, unix socket没有端口, 返回0
+func AddrPort(addr net.Addr) int {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.Port
+	}
+	return 0
+}
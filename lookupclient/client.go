@@ -0,0 +1,490 @@
+// lookupclient 实现了nsqd那一侧的nsqlookupd TCP协议
+// 连接 -> 发送"  V1" -> IDENTIFY -> REGISTER/UNREGISTER, 定时PING
+// 连接断开之后会自动重连,重连成功之后把之前注册过的topic/channel重新注册一遍
+package lookupclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/internal/util"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Logger lg.Logger
+
+var ErrClosed = errors.New("lookupclient: client closed")
+
+// ErrNotConnected 和nsqlookupd的连接断了,还没重连上
+var ErrNotConnected = errors.New("lookupclient: not connected")
+
+// 响应的最大长度, 超过了说明连接上的数据已经错位了
+const maxFrameSize = 16 * 1024 * 1024
+
+// Config nsqd的网络信息,会在IDENTIFY的时候发给nsqlookupd
+type Config struct {
+	// nsqd的唯一标识, 重连之后nsqlookupd用它认出是同一个nsqd, 为空的话nsqlookupd用地址和端口生成
+	NodeID string
+
+	BroadcastAddress string
+	Hostname         string
+	TCPPort          int
+	HTTPPort         int
+	Version          string
+	Labels           map[string]string
+
+	// 注册到哪个namespace, 为空是默认namespace, namespace配置了ACL的话要带上NamespaceToken
+	Namespace      string
+	NamespaceToken string
+
+	DialTimeout         time.Duration
+	ReadTimeout         time.Duration // 等待一个命令的响应最多多久
+	PingInterval        time.Duration
+	ReconnectBackoff    time.Duration // 重连失败之后等待时间翻倍,最多MaxReconnectBackoff
+	MaxReconnectBackoff time.Duration
+
+	Logger   Logger
+	LogLevel lg.LogLevel
+}
+
+func (c *Config) setDefaults() {
+	if c.DialTimeout == 0 {
+		c.DialTimeout = time.Second
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = 5 * time.Second
+	}
+	if c.PingInterval == 0 {
+		c.PingInterval = 15 * time.Second
+	}
+	if c.ReconnectBackoff == 0 {
+		c.ReconnectBackoff = 100 * time.Millisecond
+	}
+	if c.MaxReconnectBackoff == 0 {
+		c.MaxReconnectBackoff = 15 * time.Second
+	}
+	if c.Logger == nil {
+		c.Logger = lg.NilLogger{}
+	}
+}
+
+// IdentifyResponse nsqlookupd对IDENTIFY的响应
+type IdentifyResponse struct {
+	TCPPort          int    `json:"tcp_port"`
+	HTTPPort         int    `json:"http_port"`
+	Version          string `json:"version"`
+	BroadcastAddress string `json:"broadcast_address"`
+	Hostname         string `json:"hostname"`
+}
+
+// ProtocolError nsqlookupd返回的错误,比如 E_BAD_TOPIC xxx
+type ProtocolError struct {
+	Code string
+	Desc string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + " " + e.Desc
+}
+
+// registration 同时也是MREGISTER的body中的一项, 作为map的key的时候TTL为空
+type registration struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// MREGISTER返回的每一项的结果
+type registrationResult struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+type Client struct {
+	sync.Mutex // 一个连接上同一时间只能有一个命令在等响应
+	addr       string
+	cfg        Config
+
+	conn     net.Conn
+	reader   *bufio.Reader
+	identify *IdentifyResponse
+
+	registrations map[registration]time.Duration // 重连之后要重新注册的, value是TTL, 0表示没有TTL
+	closed        bool
+	exitChan      chan struct{}
+	reconnectChan chan struct{}
+	wg            sync.WaitGroup
+}
+
+// New 只是创建Client,要调用Connect()才会真正连接
+// addr是nsqlookupd的TCP地址 host:port, 也可以是unix:///path/to.sock
+func New(addr string, cfg Config) *Client {
+	cfg.setDefaults()
+	return &Client{
+		addr:          addr,
+		cfg:           cfg,
+		registrations: make(map[registration]time.Duration),
+		exitChan:      make(chan struct{}),
+		reconnectChan: make(chan struct{}, 1),
+	}
+}
+
+// Connect 连接nsqlookupd并IDENTIFY, 成功之后开始定时PING和自动重连
+// 第一次连接失败直接返回错误,不会重连
+func (c *Client) Connect() (*IdentifyResponse, error) {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil, ErrClosed
+	}
+	err := c.connect()
+	resp := c.identify
+	c.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c.wg.Add(1)
+	go c.loop()
+	return resp, nil
+}
+
+// 调用方要持有锁
+func (c *Client) connect() error {
+	network, address := util.ParseAddress(c.addr)
+	conn, err := net.DialTimeout(network, address, c.cfg.DialTimeout)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte("  V1"))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	body, err := json.Marshal(map[string]interface{}{
+		"node_id":           c.cfg.NodeID,
+		"broadcast_address": c.cfg.BroadcastAddress,
+		"hostname":          c.cfg.Hostname,
+		"tcp_port":          c.cfg.TCPPort,
+		"http_port":         c.cfg.HTTPPort,
+		"version":           c.cfg.Version,
+		"labels":            c.cfg.Labels,
+		"namespace":         c.cfg.Namespace,
+		"namespace_token":   c.cfg.NamespaceToken,
+	})
+	if err != nil {
+		c.closeConn()
+		return err
+	}
+	data, err := c.command("IDENTIFY", nil, body)
+	if err != nil {
+		c.closeConn()
+		return fmt.Errorf("IDENTIFY failed - %s", err)
+	}
+	var resp IdentifyResponse
+	// 老版本的nsqlookupd json编码失败的时候会返回OK
+	if string(data) != "OK" {
+		err = json.Unmarshal(data, &resp)
+		if err != nil {
+			c.closeConn()
+			return fmt.Errorf("IDENTIFY failed to decode response - %s", err)
+		}
+	}
+	c.identify = &resp
+	c.logf(lg.INFO, "LOOKUPCLIENT(%s): IDENTIFY ok (%s v%s)", c.addr, resp.Hostname, resp.Version)
+
+	err = c.replay()
+	if err != nil {
+		c.closeConn()
+		return err
+	}
+	return nil
+}
+
+// 重连之后把之前注册过的topic/channel一次性重新注册
+func (c *Client) replay() error {
+	if len(c.registrations) == 0 {
+		return nil
+	}
+	items := make([]registration, 0, len(c.registrations))
+	for r, ttl := range c.registrations {
+		if ttl > 0 {
+			r.TTL = ttl.String()
+		}
+		items = append(items, r)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Topic != items[j].Topic {
+			return items[i].Topic < items[j].Topic
+		}
+		return items[i].Channel < items[j].Channel
+	})
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	data, err := c.command("MREGISTER", nil, body)
+	if err != nil {
+		return fmt.Errorf("MREGISTER failed - %s", err)
+	}
+	var results []registrationResult
+	err = json.Unmarshal(data, &results)
+	if err != nil {
+		return fmt.Errorf("MREGISTER invalid response - %s", err)
+	}
+	// 单独的项失败了(比如超过配额)不影响其他项, 也不用重连, 记下来就行
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			failed++
+			c.logf(lg.WARN, "LOOKUPCLIENT(%s): replay of topic(%s) channel(%s) failed - %s",
+				c.addr, r.Topic, r.Channel, r.Error)
+		}
+	}
+	c.logf(lg.INFO, "LOOKUPCLIENT(%s): replayed %d registrations (%d failed)", c.addr, len(items), failed)
+	return nil
+}
+
+// 发送一个命令并读取响应, body为nil表示这个命令没有body
+// 调用方要持有锁
+func (c *Client) command(name string, params []string, body []byte) ([]byte, error) {
+	if c.conn == nil {
+		return nil, ErrNotConnected
+	}
+	line := name
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	c.conn.SetDeadline(time.Now().Add(c.cfg.ReadTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	_, err := c.conn.Write([]byte(line + "\n"))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		err = binary.Write(c.conn, binary.BigEndian, int32(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = c.conn.Write(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 响应: 4字节大端长度 + 数据
+	var size int32
+	err = binary.Read(c.reader, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxFrameSize {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(c.reader, data)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(data), "E_") {
+		parts := strings.SplitN(string(data), " ", 2)
+		perr := &ProtocolError{Code: parts[0]}
+		if len(parts) == 2 {
+			perr.Desc = parts[1]
+		}
+		return nil, perr
+	}
+	return data, nil
+}
+
+// 命令失败了,如果是网络错误就断开连接,等loop()重连
+// 调用方要持有锁
+func (c *Client) handleErr(err error) {
+	if _, ok := err.(*ProtocolError); ok {
+		return
+	}
+	if err == ErrNotConnected {
+		return
+	}
+	c.logf(lg.WARN, "LOOKUPCLIENT(%s): connection error - %s", c.addr, err)
+	c.closeConn()
+	select {
+	case c.reconnectChan <- struct{}{}:
+	default:
+	}
+}
+
+// 调用方要持有锁
+func (c *Client) closeConn() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
+
+// Register 注册topic(channel可以为空), 就算现在没连上也会记下来,重连之后自动注册
+func (c *Client) Register(topic string, channel string) error {
+	return c.registerCommand("REGISTER", topic, channel, 0)
+}
+
+// RegisterWithTTL 和Register一样, 但是最后一个producer离开ttl之后nsqlookupd会删掉这个topic/channel
+func (c *Client) RegisterWithTTL(topic string, channel string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("REGISTER ttl must be positive")
+	}
+	return c.registerCommand("REGISTER", topic, channel, ttl)
+}
+
+// Unregister 取消注册, channel为空表示该topic和下面所有的channel都取消
+func (c *Client) Unregister(topic string, channel string) error {
+	return c.registerCommand("UNREGISTER", topic, channel, 0)
+}
+
+func (c *Client) registerCommand(name string, topic string, channel string, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	// 名字里面有空格的话协议就乱了,先检查一下
+	// 其他的命名规则是nsqlookupd配置的,交给nsqlookupd检查
+	if !isSafeParam(topic) {
+		return fmt.Errorf("%s topic name '%s' is not valid", name, topic)
+	}
+	if channel != "" && !isSafeParam(channel) {
+		return fmt.Errorf("%s channel name '%s' is not valid", name, channel)
+	}
+	params := []string{topic}
+	if channel != "" {
+		params = append(params, channel)
+	}
+	if ttl > 0 {
+		params = append(params, "ttl="+ttl.String())
+	}
+	_, err := c.command(name, params, nil)
+	if _, ok := err.(*ProtocolError); ok {
+		return err // nsqlookupd拒绝了, 不用记下来
+	}
+
+	r := registration{Topic: topic, Channel: channel}
+	if name == "REGISTER" {
+		c.registrations[r] = ttl
+	} else if channel != "" {
+		delete(c.registrations, r)
+	} else {
+		for k := range c.registrations {
+			if k.Topic == topic {
+				delete(c.registrations, k)
+			}
+		}
+	}
+	if err != nil {
+		c.handleErr(err)
+	}
+	return err
+}
+
+// Ping 手动发一次PING, 一般不用调用, loop()里面会定时PING
+func (c *Client) Ping() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	_, err := c.command("PING", nil, nil)
+	if err != nil {
+		c.handleErr(err)
+	}
+	return err
+}
+
+// IdentifyResponse 最近一次IDENTIFY的响应
+func (c *Client) Identity() *IdentifyResponse {
+	c.Lock()
+	defer c.Unlock()
+	return c.identify
+}
+
+// Connected 现在是不是连着nsqlookupd
+func (c *Client) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.conn != nil
+}
+
+// 定时PING, 连接断开之后按backoff重连
+func (c *Client) loop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	backoff := c.cfg.ReconnectBackoff
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ticker.C:
+			c.Ping()
+		case <-c.reconnectChan:
+			retry = time.After(0)
+		case <-retry:
+			retry = nil
+			c.Lock()
+			if c.closed || c.conn != nil {
+				c.Unlock()
+				continue
+			}
+			err := c.connect()
+			c.Unlock()
+			if err != nil {
+				c.logf(lg.WARN, "LOOKUPCLIENT(%s): reconnect failed - %s, retrying in %s", c.addr, err, backoff)
+				retry = time.After(backoff)
+				backoff *= 2
+				if backoff > c.cfg.MaxReconnectBackoff {
+					backoff = c.cfg.MaxReconnectBackoff
+				}
+				continue
+			}
+			backoff = c.cfg.ReconnectBackoff
+		case <-c.exitChan:
+			return
+		}
+	}
+}
+
+// Close 断开连接,不会再重连
+func (c *Client) Close() error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.exitChan)
+	c.closeConn()
+	c.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Client) logf(level lg.LogLevel, f string, args ...interface{}) {
+	lg.Logf(c.cfg.Logger, c.cfg.LogLevel, level, f, args...)
+}
+
+// 命令的参数用空格分隔, 一行一个命令, 参数里不能有空白字符
+func isSafeParam(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " \t\r\n")
+}
@@ -0,0 +1,459 @@
+package lookupclient_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/lookupclient"
+	"github.com/xswwhy/nsq/nsqlookupd"
+	"github.com/xswwhy/nsq/nsqlookupd/nsqlookupdtest"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newClient(addr string) *lookupclient.Client {
+	return lookupclient.New(addr, lookupclient.Config{
+		BroadcastAddress: "127.0.0.1",
+		Hostname:         "test",
+		TCPPort:          4150,
+		HTTPPort:         4151,
+		Version:          "test",
+		PingInterval:     20 * time.Millisecond, // 断开的连接要发命令的时候才能发现
+		ReconnectBackoff: 10 * time.Millisecond,
+	})
+}
+
+func TestConnectIdentify(t *testing.T) {
+	s := nsqlookupdtest.New(t)
+	c := newClient(s.TCPAddr())
+	defer c.Close()
+
+	resp, err := c.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed - %s", err)
+	}
+	if resp.TCPPort == 0 || resp.HTTPPort == 0 || resp.Version == "" {
+		t.Fatalf("unexpected IDENTIFY response %+v", resp)
+	}
+	if c.Identity() != resp || !c.Connected() {
+		t.Fatalf("client should be connected with identity %+v", resp)
+	}
+	err = c.Ping()
+	if err != nil {
+		t.Fatalf("Ping failed - %s", err)
+	}
+}
+
+func TestRegisterUnregister(t *testing.T) {
+	s := nsqlookupdtest.New(t)
+	c := newClient(s.TCPAddr())
+	defer c.Close()
+	_, err := c.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed - %s", err)
+	}
+
+	for _, r := range [][2]string{{"orders", ""}, {"orders", "billing"}, {"orders", "audit"}, {"events", "ch"}} {
+		err = c.Register(r[0], r[1])
+		if err != nil {
+			t.Fatalf("Register(%s, %s) failed - %s", r[0], r[1], err)
+		}
+	}
+	s.AssertTopics(t, "events", "orders")
+	s.AssertChannels(t, "orders", "audit", "billing")
+	s.AssertProducers(t, "orders", "127.0.0.1:4150")
+
+	err = c.Unregister("orders", "audit")
+	if err != nil {
+		t.Fatalf("Unregister channel failed - %s", err)
+	}
+	// 不是#ephemeral的channel没有producer了也还在
+	s.AssertChannels(t, "orders", "audit", "billing")
+	if n := channelProducers(s, "orders", "audit"); n != 0 {
+		t.Fatalf("channel(audit) should have no producers, got %d", n)
+	}
+
+	// 不带channel的时候topic和下面所有的channel都取消
+	err = c.Unregister("orders", "")
+	if err != nil {
+		t.Fatalf("Unregister topic failed - %s", err)
+	}
+	s.AssertProducers(t, "orders")
+	s.AssertProducers(t, "events", "127.0.0.1:4150")
+}
+
+func TestErrorReplies(t *testing.T) {
+	s := nsqlookupdtest.New(t, func(opts *nsqlookupd.Options) {
+		opts.MaxChannelsPerTopic = 1
+	})
+
+	// IDENTIFY被拒绝, Connect直接返回错误
+	bad := lookupclient.New(s.TCPAddr(), lookupclient.Config{
+		NodeID:           "bad/node",
+		BroadcastAddress: "127.0.0.1",
+		TCPPort:          4150,
+		HTTPPort:         4151,
+	})
+	defer bad.Close()
+	_, err := bad.Connect()
+	if err == nil {
+		t.Fatalf("Connect with invalid node_id should fail")
+	}
+
+	c := newClient(s.TCPAddr())
+	defer c.Close()
+	_, err = c.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed - %s", err)
+	}
+	err = c.Register("orders", "billing")
+	if err != nil {
+		t.Fatalf("Register failed - %s", err)
+	}
+	// 普通的错误不会断开连接
+	err = c.Register("orders", "audit")
+	perr, ok := err.(*lookupclient.ProtocolError)
+	if !ok || perr.Code != "E_QUOTA_EXCEEDED" {
+		t.Fatalf("expected E_QUOTA_EXCEEDED, got %v", err)
+	}
+	err = c.Ping()
+	if err != nil {
+		t.Fatalf("Ping after E_QUOTA_EXCEEDED failed - %s", err)
+	}
+	s.AssertChannels(t, "orders", "billing")
+
+	// 有空格的名字在本地就拒绝了, 不会发给nsqlookupd
+	err = c.Register("bad topic", "")
+	if err == nil {
+		t.Fatalf("Register with whitespace should fail")
+	}
+	if _, ok := err.(*lookupclient.ProtocolError); ok {
+		t.Fatalf("whitespace should be rejected locally, got %v", err)
+	}
+
+	// 名字不合法是致命错误, nsqlookupd会断开连接, 之后的命令发现连接断了会自动重连
+	err = c.Register("bad!topic", "")
+	perr, ok = err.(*lookupclient.ProtocolError)
+	if !ok || perr.Code != "E_BAD_TOPIC" {
+		t.Fatalf("expected E_BAD_TOPIC, got %v", err)
+	}
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return c.Connected() && c.Ping() == nil
+	}, "client reconnects after a fatal error")
+	s.AssertTopics(t, "orders")
+	s.AssertChannels(t, "orders", "billing")
+}
+
+func TestReconnectReplaysRegistrations(t *testing.T) {
+	s := nsqlookupdtest.New(t)
+	p := newProxy(t, s.TCPAddr())
+	c := newClient(p.addr())
+	defer c.Close()
+	_, err := c.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed - %s", err)
+	}
+	for _, r := range [][2]string{{"orders", "billing"}, {"orders", "audit"}, {"events", ""}} {
+		err = c.Register(r[0], r[1])
+		if err != nil {
+			t.Fatalf("Register(%s, %s) failed - %s", r[0], r[1], err)
+		}
+	}
+	err = c.Unregister("orders", "audit")
+	if err != nil {
+		t.Fatalf("Unregister failed - %s", err)
+	}
+
+	// 重连之后用MREGISTER一次性恢复
+	p.dropAll()
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return p.accepted() == 2 && c.Connected() &&
+			channelProducers(s, "orders", "billing") == 1 && len(s.Producers("events")) == 1
+	}, "registrations replayed after reconnect")
+	if n := channelProducers(s, "orders", "audit"); n != 0 {
+		t.Fatalf("unregistered channel(audit) should not be replayed, got %d producers", n)
+	}
+
+	// 断开的时候Register会失败, 但是记下来了, 重连之后也会注册
+	p.setPaused(true)
+	p.dropAll()
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return !c.Connected()
+	}, "client notices the dropped connection")
+	err = c.Register("late", "")
+	if err != lookupclient.ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+	p.setPaused(false)
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return len(s.Producers("late")) == 1
+	}, "registration made while disconnected is replayed")
+	s.AssertTopics(t, "events", "late", "orders")
+}
+
+func TestInvalidResponseSize(t *testing.T) {
+	for _, size := range []int32{-1, 1 << 30} {
+		f := newFakeLookupd(t, func(name string, body []byte) []byte {
+			return nil
+		})
+		f.size = size
+		c := newClient(f.addr())
+		_, err := c.Connect()
+		c.Close()
+		if err == nil || !strings.Contains(err.Error(), "invalid response size") {
+			t.Fatalf("expected invalid response size error for %d, got %v", size, err)
+		}
+	}
+}
+
+func TestReplayLogsFailedItems(t *testing.T) {
+	f := newFakeLookupd(t, func(name string, body []byte) []byte {
+		switch name {
+		case "IDENTIFY":
+			return []byte(`{"tcp_port":4160,"http_port":4161,"version":"test"}`)
+		case "MREGISTER":
+			return []byte(`[{"topic":"orders","ok":true},` +
+				`{"topic":"orders","channel":"billing","ok":false,"error":"E_QUOTA_EXCEEDED MREGISTER too many channels"}]`)
+		}
+		return []byte("OK")
+	})
+	logger := &testLogger{}
+	c := lookupclient.New(f.addr(), lookupclient.Config{
+		BroadcastAddress: "127.0.0.1",
+		TCPPort:          4150,
+		HTTPPort:         4151,
+		PingInterval:     20 * time.Millisecond,
+		ReconnectBackoff: 10 * time.Millisecond,
+		Logger:           logger,
+		LogLevel:         lg.WARN,
+	})
+	defer c.Close()
+	_, err := c.Connect()
+	if err != nil {
+		t.Fatalf("Connect failed - %s", err)
+	}
+	for _, r := range [][2]string{{"orders", ""}, {"orders", "billing"}} {
+		err = c.Register(r[0], r[1])
+		if err != nil {
+			t.Fatalf("Register(%s, %s) failed - %s", r[0], r[1], err)
+		}
+	}
+
+	// 单独的项失败了也算重连成功, 但是要记日志
+	f.dropAll()
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return logger.contains("replay of topic(orders) channel(billing) failed - E_QUOTA_EXCEEDED")
+	}, "failed replay item is logged")
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return c.Connected() && c.Ping() == nil
+	}, "client stays connected after a partial replay")
+}
+
+type testLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Output(maxdepth int, s string) error {
+	l.Lock()
+	defer l.Unlock()
+	l.lines = append(l.lines, s)
+	return nil
+}
+
+func (l *testLogger) contains(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// 假的nsqlookupd, 用来返回真的nsqlookupd不会返回的响应
+type fakeLookupd struct {
+	listener net.Listener
+	handler  func(name string, body []byte) []byte
+	size     int32 // 不为0的时候响应的长度都用这个
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeLookupd(t *testing.T, handler func(name string, body []byte) []byte) *fakeLookupd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %s", err)
+	}
+	f := &fakeLookupd{listener: listener, handler: handler}
+	go f.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		f.dropAll()
+	})
+	return f
+}
+
+func (f *fakeLookupd) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeLookupd) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, conn)
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeLookupd) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(reader, magic)
+	if err != nil {
+		return
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		name := strings.Fields(line)[0]
+		var body []byte
+		if name == "IDENTIFY" || name == "MREGISTER" || name == "MUNREGISTER" {
+			var bodyLen int32
+			err = binary.Read(reader, binary.BigEndian, &bodyLen)
+			if err != nil {
+				return
+			}
+			body = make([]byte, bodyLen)
+			_, err = io.ReadFull(reader, body)
+			if err != nil {
+				return
+			}
+		}
+		resp := f.handler(name, body)
+		size := int32(len(resp))
+		if f.size != 0 {
+			size = f.size
+		}
+		err = binary.Write(conn, binary.BigEndian, size)
+		if err != nil {
+			return
+		}
+		_, err = conn.Write(resp)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeLookupd) dropAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func channelProducers(s *nsqlookupdtest.Server, topic string, channel string) int {
+	return len(s.DB.FindProducers("", "channel", topic, channel, nil))
+}
+
+// 测试用的TCP代理, 可以模拟nsqlookupd断开连接
+type proxy struct {
+	listener net.Listener
+	target   string
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	count  int
+	paused bool // 暂停的时候新连接马上断开, 模拟nsqlookupd连不上
+}
+
+func newProxy(t *testing.T, target string) *proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen - %s", err)
+	}
+	p := &proxy{listener: listener, target: target}
+	go p.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		p.dropAll()
+	})
+	return p
+}
+
+func (p *proxy) addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *proxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		paused := p.paused
+		p.mu.Unlock()
+		if paused {
+			conn.Close()
+			continue
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, conn, upstream)
+		p.count++
+		p.mu.Unlock()
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		go func() {
+			io.Copy(conn, upstream)
+			conn.Close()
+		}()
+	}
+}
+
+// 断开所有的连接, 两边都能马上发现
+func (p *proxy) dropAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *proxy) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+}
+
+// 转发过的连接数
+func (p *proxy) accepted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
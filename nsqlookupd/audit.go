@@ -0,0 +1,238 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// 审计日志记录的操作类型
+const (
+	AuditIdentify      = "IDENTIFY"
+	AuditRegister      = "REGISTER"
+	AuditUnregister    = "UNREGISTER"
+	AuditDisconnect    = "DISCONNECT"
+	AuditReplace       = "REPLACE" // 同一个node_id的新连接替换了旧连接
+	AuditCreateTopic   = "CREATE_TOPIC"
+	AuditDeleteTopic   = "DELETE_TOPIC"
+	AuditCreateChannel = "CREATE_CHANNEL"
+	AuditDeleteChannel = "DELETE_CHANNEL"
+	AuditTombstone     = "TOMBSTONE"
+	AuditDrain         = "DRAIN"
+	AuditUndrain       = "UNDRAIN"
+	AuditExpire        = "EXPIRE" // 没有producer超过TTL被reaper删掉
+	AuditImport        = "IMPORT" // 从导出的json导入的
+)
+
+// AuditEvent RegistrationDB的一次修改
+// 是nsqd通过TCP改的话会有PeerID和Node, 是通过HTTP管理接口改的话只有ClientAddr
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Op         string    `json:"op"`
+	ClientAddr string    `json:"client_addr"`
+	PeerID     string    `json:"peer_id,omitempty"`
+	Node       string    `json:"node,omitempty"` // broadcast_address:http_port, 和tombstone接口的node参数格式一样
+	Namespace  string    `json:"namespace,omitempty"`
+	Category   string    `json:"category"`
+	Key        string    `json:"key"`
+	SubKey     string    `json:"subkey"`
+}
+
+// 按topic或者node过滤, 空字符串表示不过滤
+func (e *AuditEvent) isMatch(topic string, node string) bool {
+	if topic != "" && e.Key != topic {
+		return false
+	}
+	if node != "" && e.Node != node && e.PeerID != node {
+		return false
+	}
+	return true
+}
+
+// AuditLog 只追加的审计日志
+// 内存里面用环形缓冲区保留最近的size条, 配置了文件的话每条都会写一行json到文件里
+type AuditLog struct {
+	sync.RWMutex
+	events []AuditEvent
+	next   int  // 下一条要写的位置
+	full   bool // 环形缓冲区是不是已经写满一圈了
+	file   *rotatingFile
+}
+
+func NewAuditLog(size int, path string, maxBytes int64, maxBackups int) (*AuditLog, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid audit log size %d", size)
+	}
+	a := &AuditLog{
+		events: make([]AuditEvent, size),
+	}
+	if path != "" {
+		f, err := newRotatingFile(path, maxBytes, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *AuditLog) Record(e AuditEvent) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.events[a.next] = e
+	a.next = (a.next + 1) % len(a.events)
+	if a.next == 0 {
+		a.full = true
+	}
+	if a.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return a.file.Write(append(line, '\n'))
+}
+
+// Query 从新到旧返回匹配的事件, limit <= 0 表示不限制条数
+func (a *AuditLog) Query(topic string, node string, limit int) []AuditEvent {
+	a.RLock()
+	defer a.RUnlock()
+	count := a.next
+	if a.full {
+		count = len(a.events)
+	}
+	results := []AuditEvent{}
+	for i := 1; i <= count; i++ {
+		e := &a.events[(a.next-i+len(a.events))%len(a.events)]
+		if !e.isMatch(topic, node) {
+			continue
+		}
+		results = append(results, *e)
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+	}
+	return results
+}
+
+func (a *AuditLog) Close() error {
+	a.Lock()
+	defer a.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// 按大小切割的日志文件
+// 文件超过maxBytes之后 path -> path.1 -> path.2 ... 最多保留maxBackups个旧文件
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	renamed    bool // 旧文件已经挪走了, 新文件还没有打开成功
+}
+
+func newRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s - %s", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log %s - %s", r.path, err)
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) error {
+	var rerr error
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		// 切割失败的话继续写原来的文件, 下次写的时候再试
+		rerr = r.rotate()
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+// 新文件打开成功之后才关掉旧文件
+func (r *rotatingFile) rotate() error {
+	if !r.renamed {
+		if r.maxBackups < 1 {
+			os.Remove(r.path)
+		} else {
+			// 从最旧的开始往后挪, 最旧的那个直接被覆盖掉
+			for i := r.maxBackups - 1; i >= 1; i-- {
+				os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+			}
+			err := os.Rename(r.path, r.path+".1")
+			if err != nil {
+				return fmt.Errorf("failed to rotate audit log %s - %s", r.path, err)
+			}
+		}
+		r.renamed = true
+	}
+	old := r.file
+	err := r.open()
+	if err != nil {
+		return err
+	}
+	r.renamed = false
+	old.Close()
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
+
+// 记录一条审计日志, peerInfo为nil表示是HTTP管理接口的操作
+func (l *NSQLookupd) audit(op string, clientAddr string, peerInfo *PeerInfo, k Registration) {
+	if l.auditLog == nil {
+		return
+	}
+	e := AuditEvent{
+		Op:         op,
+		ClientAddr: clientAddr,
+		Namespace:  k.Namespace,
+		Category:   k.Category,
+		Key:        k.Key,
+		SubKey:     k.SubKey,
+	}
+	if peerInfo != nil {
+		e.PeerID = peerInfo.id
+		e.Node = peerInfo.node()
+	}
+	err := l.auditLog.Record(e)
+	if err != nil {
+		l.logf(LOG_ERROR, "failed to write audit log - %s", err)
+	}
+}
@@ -1,15 +1,30 @@
 package nsqlookupd
 
 import (
+	"fmt"
 	"net"
+	"sync/atomic"
 )
 
 type ClientV1 struct {
 	net.Conn
 	peerInfo *PeerInfo
+	id       string // 作为peerInfo.RemoteAddress, TCP连接就是 ip:port
 }
 
+// unix socket连接的编号
+var unixClientSeq int64
+
 func NewClientV1(conn net.Conn) *ClientV1 {
 	// 注意:刚建立连接的Client是没有peerInfo的
-	return &ClientV1{Conn: conn}
+	return &ClientV1{Conn: conn, id: clientID(conn)}
+}
+
+// unix socket的连接RemoteAddr都是一样的(@或者空), 不能作为id, 每个连接编一个号
+func clientID(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil || addr.Network() == "unix" {
+		return fmt.Sprintf("unix:%d", atomic.AddInt64(&unixClientSeq, 1))
+	}
+	return addr.String()
 }
@@ -0,0 +1,61 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// 维护nsqd的时候把整个节点从lookup结果中摘掉, 它的Registration都保留着, undrain之后马上恢复
+// 节点用 broadcast_address:http_port 表示, 和tombstone接口的node参数一样
+// 被drain的节点地址记在NSQLookupd里, nsqd维护期间重启了重新IDENTIFY也还是drain的状态
+// drain只对一个namespace生效, 同一个nsqd在别的namespace里不受影响
+
+func (p *PeerInfo) node() string {
+	return fmt.Sprintf("%s:%d", p.BroadcastAddress, p.HTTPPort)
+}
+
+func (p *PeerInfo) IsDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+func (p *PeerInfo) setDraining(draining bool) {
+	if draining {
+		atomic.StoreInt32(&p.draining, 1)
+	} else {
+		atomic.StoreInt32(&p.draining, 0)
+	}
+}
+
+// drainedNodes的key
+func drainKey(namespace string, node string) string {
+	return namespace + "/" + node
+}
+
+// 设置节点的drain状态, 返回当前连着的匹配的producer
+// 在DB的事务里改, IDENTIFY也是在事务里检查drain状态并注册的, 两边不会交错漏掉刚连上来的nsqd
+func (l *NSQLookupd) setNodeDraining(namespace string, node string, draining bool) []*PeerInfo {
+	var matched []*PeerInfo
+	l.DB.Update(func(tx *RegistrationTx) {
+		l.Lock()
+		if draining {
+			l.drainedNodes[drainKey(namespace, node)] = true
+		} else {
+			delete(l.drainedNodes, drainKey(namespace, node))
+		}
+		l.Unlock()
+
+		for _, p := range tx.db.registrationMap[Registration{namespace, "client", "", ""}] {
+			if p.peerInfo.node() == node {
+				p.peerInfo.setDraining(draining)
+				matched = append(matched, p.peerInfo)
+			}
+		}
+	})
+	return matched
+}
+
+func (l *NSQLookupd) isNodeDrained(namespace string, node string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.drainedNodes[drainKey(namespace, node)]
+}
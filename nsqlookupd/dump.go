@@ -0,0 +1,294 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"github.com/xswwhy/nsq/internal/protocol"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 整个RegistrationDB导出成json, 迁移集群或者灾备恢复的时候导入到别的nsqlookupd
+// 同一个nsqd在很多Registration里都有, producer单独放一个map, Registration里只记id
+
+const RegistrationDumpVersion = 1
+
+// 导入的方式
+const (
+	ImportMerge   = "merge"   // 已经有的Registration和producer保持不变, 只加上没有的
+	ImportReplace = "replace" // 先清空DB再导入, 静态producer除外
+)
+
+type RegistrationDump struct {
+	Version       int                  `json:"version"`
+	ExportedAt    time.Time            `json:"exported_at"`
+	Producers     map[string]*DumpPeer `json:"producers"`
+	Registrations []DumpRegistration   `json:"registrations"`
+}
+
+type DumpPeer struct {
+	*PeerInfo
+	LastUpdate time.Time `json:"last_update"`
+	Static     bool      `json:"static,omitempty"` // 静态producer只导出看看, 导入的时候跳过, 以目标nsqlookupd的配置为准
+}
+
+type DumpRegistration struct {
+	Namespace string         `json:"namespace,omitempty"`
+	Category  string         `json:"category"`
+	Key       string         `json:"key"`
+	SubKey    string         `json:"subkey,omitempty"`
+	TTL       string         `json:"ttl,omitempty"`
+	Producers []DumpProducer `json:"producers"`
+}
+
+type DumpProducer struct {
+	ID          string     `json:"id"`
+	Tombstoned  bool       `json:"tombstoned,omitempty"`
+	TombstoneAt *time.Time `json:"tombstone_at,omitempty"`
+}
+
+// ImportResult 导入了多少东西
+type ImportResult struct {
+	Mode          string `json:"mode"`
+	Registrations int    `json:"registrations"` // 新加的Registration
+	Producers     int    `json:"producers"`     // 新加的(Registration, producer)
+	Removed       int    `json:"removed"`       // replace的时候删掉的Registration
+}
+
+func (k Registration) dump() DumpRegistration {
+	return DumpRegistration{
+		Namespace: k.Namespace,
+		Category:  k.Category,
+		Key:       k.Key,
+		SubKey:    k.SubKey,
+	}
+}
+
+func (d DumpRegistration) registration() Registration {
+	return Registration{d.Namespace, d.Category, d.Key, d.SubKey}
+}
+
+// Export 在读锁里导出整个DB, Registration按namespace category key subkey排序
+func (r *RegistrationDB) Export() *RegistrationDump {
+	r.RLock()
+	defer r.RUnlock()
+	dump := &RegistrationDump{
+		Version:       RegistrationDumpVersion,
+		ExportedAt:    time.Now(),
+		Producers:     make(map[string]*DumpPeer),
+		Registrations: make([]DumpRegistration, 0, len(r.registrationMap)),
+	}
+	for k, producers := range r.registrationMap {
+		d := k.dump()
+		if lc, ok := r.lifecycles[k]; ok && lc.ttl > 0 {
+			d.TTL = lc.ttl.String()
+		}
+		d.Producers = make([]DumpProducer, 0, len(producers))
+		for id, p := range producers {
+			if _, ok := dump.Producers[id]; !ok {
+				dump.Producers[id] = &DumpPeer{
+					PeerInfo:   p.peerInfo,
+					LastUpdate: time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate)),
+					Static:     p.peerInfo.static,
+				}
+			}
+			dp := DumpProducer{ID: id}
+			if at, tombstoned := p.TombstonedAt(); tombstoned {
+				dp.Tombstoned = true
+				dp.TombstoneAt = &at
+			}
+			d.Producers = append(d.Producers, dp)
+		}
+		sort.Slice(d.Producers, func(i, j int) bool { return d.Producers[i].ID < d.Producers[j].ID })
+		dump.Registrations = append(dump.Registrations, d)
+	}
+	sort.Slice(dump.Registrations, func(i, j int) bool {
+		a, b := dump.Registrations[i], dump.Registrations[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.SubKey < b.SubKey
+	})
+	return dump
+}
+
+// 导入之前先整个检查一遍, 有问题的话什么都不导入
+func (dump *RegistrationDump) validate(policy *protocol.NamePolicy) error {
+	if dump.Version != RegistrationDumpVersion {
+		return fmt.Errorf("unsupported dump version %d", dump.Version)
+	}
+	for id, peer := range dump.Producers {
+		if peer == nil || peer.PeerInfo == nil {
+			return fmt.Errorf("producer %q has no peer info", id)
+		}
+		if !isValidNamespace(peer.Namespace) {
+			return fmt.Errorf("producer %q has invalid namespace %q", id, peer.Namespace)
+		}
+		// 静态producer导入的时候会跳过, 其他的id必须是 namespace/node_id, 和IDENTIFY的时候生成的一样
+		if !peer.Static {
+			if peer.NodeID == "" {
+				return fmt.Errorf("producer %q has no node_id", id)
+			}
+			if err := validateNodeID(peer.NodeID); err != nil {
+				return fmt.Errorf("producer %q - %s", id, err)
+			}
+			if id != peerID(peer.Namespace, peer.NodeID) {
+				return fmt.Errorf("producer %q does not match node_id %q in namespace %q", id, peer.NodeID, peer.Namespace)
+			}
+		}
+		if err := validateLabels(peer.Labels); err != nil {
+			return fmt.Errorf("producer %q - %s", id, err)
+		}
+	}
+	for _, d := range dump.Registrations {
+		if !isValidNamespace(d.Namespace) {
+			return fmt.Errorf("invalid namespace %q", d.Namespace)
+		}
+		switch d.Category {
+		case "client":
+			if d.Key != "" || d.SubKey != "" {
+				return fmt.Errorf("client registration must not have key or subkey")
+			}
+		case "topic":
+			if err := policy.ValidateSyntax(d.Key); err != nil {
+				return fmt.Errorf("topic %q - %s", d.Key, err)
+			}
+			if d.SubKey != "" {
+				return fmt.Errorf("topic %q must not have subkey", d.Key)
+			}
+		case "channel":
+			if err := policy.ValidateSyntax(d.Key); err != nil {
+				return fmt.Errorf("topic %q - %s", d.Key, err)
+			}
+			if err := policy.ValidateSyntax(d.SubKey); err != nil {
+				return fmt.Errorf("channel %q in topic %q - %s", d.SubKey, d.Key, err)
+			}
+		default:
+			return fmt.Errorf("invalid category %q", d.Category)
+		}
+		if d.TTL != "" {
+			if _, err := parseTTL(d.TTL); err != nil {
+				return fmt.Errorf("%s %q has invalid ttl %q - %s", d.Category, d.Key, d.TTL, err)
+			}
+		}
+		for _, dp := range d.Producers {
+			peer, ok := dump.Producers[dp.ID]
+			if !ok {
+				return fmt.Errorf("%s %q references unknown producer %q", d.Category, d.Key, dp.ID)
+			}
+			if peer.Namespace != d.Namespace {
+				return fmt.Errorf("%s %q in namespace %q references producer %q from namespace %q",
+					d.Category, d.Key, d.Namespace, dp.ID, peer.Namespace)
+			}
+		}
+	}
+	return nil
+}
+
+// Import 在一个事务里导入, 不检查配额
+// 导入的producer没有TCP连接, lastUpdate从导入的时间开始算, 超过InactiveProducerTimeout没有重新连上来的话lookup就不再返回它了
+// 和接管过来的Registration一样, 超过InactiveProducerTimeout没有被连着的nsqd重新REGISTER的话由reaper删掉
+// 已经连着的nsqd的producer不会被导入的覆盖
+func (r *RegistrationDB) Import(dump *RegistrationDump, mode string) (ImportResult, Registrations) {
+	res := ImportResult{Mode: mode}
+	var added Registrations
+	r.Update(func(tx *RegistrationTx) {
+		db := tx.db
+		if mode == ImportReplace {
+			res.Removed = db.clearNonStatic()
+		}
+
+		// 同一个id在DB里已经有了的话用原来的PeerInfo, 保证一个id只有一个PeerInfo
+		peers := make(map[string]*PeerInfo)
+		for _, producers := range db.registrationMap {
+			for id, p := range producers {
+				peers[id] = p.peerInfo
+			}
+		}
+		importedAt := time.Now()
+		now := importedAt.UnixNano()
+		for id, peer := range dump.Producers {
+			if peer.Static {
+				continue
+			}
+			if _, ok := peers[id]; ok {
+				continue
+			}
+			peerInfo := *peer.PeerInfo
+			peerInfo.id = id
+			peerInfo.lastUpdate = now
+			peers[id] = &peerInfo
+		}
+
+		for _, d := range dump.Registrations {
+			if dump.onlyStatic(d) {
+				continue
+			}
+			k := d.registration()
+			if _, exists := db.registrationMap[k]; !exists {
+				db.addRegistration(k)
+				res.Registrations++
+				added = append(added, k)
+			}
+			if d.TTL != "" {
+				if _, ok := db.lifecycles[k]; !ok || mode == ImportReplace {
+					ttl, _ := parseTTL(d.TTL) // validate里已经检查过了
+					db.setTTL(k, ttl)
+				}
+			}
+			for _, dp := range d.Producers {
+				if dump.Producers[dp.ID].Static {
+					continue
+				}
+				p := &Producer{peerInfo: peers[dp.ID], inheritedAt: importedAt}
+				if dp.Tombstoned && dp.TombstoneAt != nil {
+					p.tombstoneAt = dp.TombstoneAt.UnixNano()
+				}
+				if db.addProducer(k, p) {
+					res.Producers++
+				}
+			}
+		}
+	})
+	return res, added
+}
+
+// 只有静态producer的Registration是源nsqlookupd的配置产生的, 不导入
+func (dump *RegistrationDump) onlyStatic(d DumpRegistration) bool {
+	if len(d.Producers) == 0 {
+		return false
+	}
+	for _, dp := range d.Producers {
+		if !dump.Producers[dp.ID].Static {
+			return false
+		}
+	}
+	return true
+}
+
+// 调用方要持有写锁
+// 删掉所有非静态的producer和它们的Registration, 返回删掉了多少个Registration
+func (r *RegistrationDB) clearNonStatic() int {
+	removed := 0
+	for k, producers := range r.registrationMap {
+		static := false
+		for id, p := range producers {
+			if p.peerInfo.static {
+				static = true
+				continue
+			}
+			r.removeProducer(k, id)
+		}
+		if !static {
+			r.removeRegistration(k)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,137 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthChecker 定时请求每个nsqd的 http://broadcast_address:http_port/ping
+// 连续失败failureThreshold次之后标记为unhealthy, lookup的时候不再返回它, 成功一次就恢复
+// nsqd的PING只能说明它和nsqlookupd之间的TCP连接是好的,consumer不一定连得上它的端口,静态producer更是连PING都没有
+// 注意地址是IDENTIFY里客户端自己填的, 不可信的客户端可以借nsqlookupd去请求内网的任意地址
+type healthChecker struct {
+	nsqlookupd       *NSQLookupd
+	client           *http.Client
+	interval         time.Duration
+	failureThreshold int
+	failures         map[string]int // peerInfo.id -> 连续失败次数, 只在loop里面访问
+	exitChan         chan struct{}
+}
+
+func newHealthChecker(l *NSQLookupd, opts *Options) (*healthChecker, error) {
+	if opts.HealthCheckFailureThreshold < 1 {
+		return nil, fmt.Errorf("invalid health check failure threshold %d", opts.HealthCheckFailureThreshold)
+	}
+	return &healthChecker{
+		nsqlookupd:       l,
+		client:           &http.Client{Timeout: opts.HealthCheckTimeout},
+		interval:         opts.HealthCheckInterval,
+		failureThreshold: opts.HealthCheckFailureThreshold,
+		failures:         make(map[string]int),
+		exitChan:         make(chan struct{}),
+	}, nil
+}
+
+func (h *healthChecker) loop() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.checkAll()
+		case <-h.exitChan:
+			h.nsqlookupd.logf(LOG_INFO, "HEALTH: closing")
+			return
+		}
+	}
+}
+
+// 并发检查所有的producer, 等全部返回了再更新状态
+func (h *healthChecker) checkAll() {
+	producers := h.nsqlookupd.DB.FindProducers("*", "client", "", "", nil)
+	errs := make([]error, len(producers))
+	var wg sync.WaitGroup
+	for i, p := range producers {
+		wg.Add(1)
+		go func(i int, peerInfo *PeerInfo) {
+			defer wg.Done()
+			errs[i] = h.probe(peerInfo)
+		}(i, p.peerInfo)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, len(producers))
+	for i, p := range producers {
+		peerInfo := p.peerInfo
+		seen[peerInfo.id] = true
+		if errs[i] == nil {
+			h.failures[peerInfo.id] = 0
+			if peerInfo.setHealthy(true) {
+				h.nsqlookupd.logf(LOG_INFO, "HEALTH: %s is healthy again", p)
+			}
+			continue
+		}
+		h.failures[peerInfo.id]++
+		h.nsqlookupd.logf(LOG_DEBUG, "HEALTH: %s ping failed (%d/%d) - %s",
+			p, h.failures[peerInfo.id], h.failureThreshold, errs[i])
+		if h.failures[peerInfo.id] >= h.failureThreshold && peerInfo.setHealthy(false) {
+			h.nsqlookupd.logf(LOG_WARN, "HEALTH: %s marked unhealthy after %d failures - %s",
+				p, h.failures[peerInfo.id], errs[i])
+		}
+	}
+	// 已经断开的producer不用再记了
+	for id := range h.failures {
+		if !seen[id] {
+			delete(h.failures, id)
+		}
+	}
+}
+
+func (h *healthChecker) probe(peerInfo *PeerInfo) error {
+	addr := net.JoinHostPort(peerInfo.BroadcastAddress, strconv.Itoa(peerInfo.HTTPPort))
+	resp, err := h.client.Get("http://" + addr + "/ping")
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got response %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *healthChecker) Close() {
+	close(h.exitChan)
+}
+
+// 没开健康检查的时候所有的producer都是healthy的
+func (p *PeerInfo) IsHealthy() bool {
+	return atomic.LoadInt32(&p.unhealthy) == 0
+}
+
+// 返回状态是不是变了
+func (p *PeerInfo) setHealthy(healthy bool) bool {
+	if healthy {
+		return atomic.CompareAndSwapInt32(&p.unhealthy, 1, 0)
+	}
+	return atomic.CompareAndSwapInt32(&p.unhealthy, 0, 1)
+}
+
+// 去掉健康检查失败的producer
+func (pp Producers) FilterByHealthy() Producers {
+	results := Producers{}
+	for _, p := range pp {
+		if p.peerInfo.IsHealthy() {
+			results = append(results, p)
+		}
+	}
+	return results
+}
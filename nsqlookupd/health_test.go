@@ -0,0 +1,103 @@
+package nsqlookupd_test
+
+import (
+	"encoding/json"
+	"github.com/xswwhy/nsq/nsqlookupd"
+	"github.com/xswwhy/nsq/nsqlookupd/nsqlookupdtest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 假的nsqd HTTP端口, okBudget>0的时候/ping返回200并减一, 小于0的时候一直返回200
+type pingStub struct {
+	okBudget int32
+	probes   int32
+}
+
+func (p *pingStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/ping" {
+		http.NotFound(w, req)
+		return
+	}
+	atomic.AddInt32(&p.probes, 1)
+	budget := atomic.LoadInt32(&p.okBudget)
+	if budget < 0 || (budget > 0 && atomic.CompareAndSwapInt32(&p.okBudget, budget, budget-1)) {
+		w.Write([]byte("OK"))
+		return
+	}
+	http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+}
+
+func stubPort(srv *httptest.Server) int {
+	return srv.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// /lookup返回的producer的http_port
+func lookupHTTPPorts(t *testing.T, s *nsqlookupdtest.Server, topic string) map[int]bool {
+	t.Helper()
+	resp, err := http.Get("http://" + s.HTTPAddr() + "/lookup?topic=" + topic)
+	if err != nil {
+		t.Fatalf("lookup failed - %s", err)
+	}
+	defer resp.Body.Close()
+	var data struct {
+		Producers []nsqlookupd.PeerInfo `json:"producers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		t.Fatalf("failed to decode lookup response - %s", err)
+	}
+	ports := make(map[int]bool)
+	for _, p := range data.Producers {
+		ports[p.HTTPPort] = true
+	}
+	return ports
+}
+
+func TestHealthCheckExcludesUnhealthyProducer(t *testing.T) {
+	const threshold = 3
+	healthy := &pingStub{okBudget: -1}
+	healthySrv := httptest.NewServer(healthy)
+	defer healthySrv.Close()
+	flaky := &pingStub{}
+	flakySrv := httptest.NewServer(flaky)
+	defer flakySrv.Close()
+
+	s := nsqlookupdtest.New(t, func(opts *nsqlookupd.Options) {
+		opts.HealthCheckInterval = 50 * time.Millisecond
+		opts.HealthCheckTimeout = time.Second
+		opts.HealthCheckFailureThreshold = threshold
+	})
+	topics := map[string][]string{"orders": nil}
+	s.MustRegisterProducer(t, nsqlookupdtest.FakeProducer{TCPPort: 4150, HTTPPort: stubPort(healthySrv), Topics: topics})
+	s.MustRegisterProducer(t, nsqlookupdtest.FakeProducer{TCPPort: 4160, HTTPPort: stubPort(flakySrv), Topics: topics})
+
+	// 失败次数不到threshold之前还在
+	ports := lookupHTTPPorts(t, s, "orders")
+	if !ports[stubPort(healthySrv)] || !ports[stubPort(flakySrv)] {
+		t.Fatalf("both producers should be returned before any probe, got %v", ports)
+	}
+
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return !lookupHTTPPorts(t, s, "orders")[stubPort(flakySrv)]
+	}, "failing producer excluded from /lookup")
+	if n := atomic.LoadInt32(&flaky.probes); n < threshold {
+		t.Fatalf("producer excluded after %d probes, want at least %d", n, threshold)
+	}
+	if !lookupHTTPPorts(t, s, "orders")[stubPort(healthySrv)] {
+		t.Fatalf("healthy producer should still be returned")
+	}
+
+	// 成功一次就恢复, 之后又一直失败
+	atomic.StoreInt32(&flaky.okBudget, 1)
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return lookupHTTPPorts(t, s, "orders")[stubPort(flakySrv)]
+	}, "producer returned to /lookup after one successful probe")
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return !lookupHTTPPorts(t, s, "orders")[stubPort(flakySrv)]
+	}, "producer excluded again after more failures")
+}
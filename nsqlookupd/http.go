@@ -0,0 +1,580 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/http_api"
+	"github.com/xswwhy/nsq/internal/version"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP服务主要给nsqadmin和consumer用,用来查询topic在哪些nsqd上
+type httpServer struct {
+	nsqlookupd *NSQLookupd
+	mux        *http.ServeMux
+}
+
+func newHTTPServer(l *NSQLookupd) *httpServer {
+	s := &httpServer{
+		nsqlookupd: l,
+		mux:        http.NewServeMux(),
+	}
+	logf := l.logf
+
+	s.mux.HandleFunc("/ping", http_api.PlainText(s.pingHandler))
+	s.mux.HandleFunc("/info", http_api.V1(http_api.Methods(s.doInfo, "GET"), logf))
+	s.mux.HandleFunc("/stats", http_api.V1(http_api.Methods(s.doStats, "GET"), logf))
+
+	// 查询相关
+	s.mux.HandleFunc("/lookup", http_api.V1(http_api.Methods(s.doLookup, "GET"), logf))
+	s.mux.HandleFunc("/topics", http_api.V1(http_api.Methods(s.doTopics, "GET"), logf))
+	s.mux.HandleFunc("/channels", http_api.V1(http_api.Methods(s.doChannels, "GET"), logf))
+	s.mux.HandleFunc("/nodes", http_api.V1(http_api.Methods(s.doNodes, "GET"), logf))
+
+	// 管理相关
+	s.mux.HandleFunc("/topic/create", http_api.V1(http_api.Methods(s.doCreateTopic, "POST"), logf))
+	s.mux.HandleFunc("/topic/delete", http_api.V1(http_api.Methods(s.doDeleteTopic, "POST"), logf))
+	s.mux.HandleFunc("/channel/create", http_api.V1(http_api.Methods(s.doCreateChannel, "POST"), logf))
+	s.mux.HandleFunc("/channel/delete", http_api.V1(http_api.Methods(s.doDeleteChannel, "POST"), logf))
+	s.mux.HandleFunc("/topic/tombstone", http_api.V1(http_api.Methods(s.doTombstoneTopicProducer, "POST"), logf))
+	s.mux.HandleFunc("/node/drain", http_api.V1(http_api.Methods(s.doDrainNode, "POST"), logf))
+	s.mux.HandleFunc("/node/undrain", http_api.V1(http_api.Methods(s.doUndrainNode, "POST"), logf))
+
+	// 审计日志
+	s.mux.HandleFunc("/audit", http_api.V1(http_api.Methods(s.doAudit, "GET"), logf))
+
+	// 导入导出整个DB
+	s.mux.HandleFunc("/debug/registrations", http_api.V1(http_api.Methods(s.doRegistrations, "GET", "POST"), logf))
+
+	// 热加载配置
+	s.mux.HandleFunc("/config/reload", http_api.V1(http_api.Methods(s.doReloadConfig, "POST"), logf))
+	return s
+}
+
+func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+// 开始关闭之后返回503, 负载均衡就不会再把请求转过来了
+func (s *httpServer) pingHandler(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	if s.nsqlookupd.ShutdownPhase() != PhaseRunning {
+		return nil, http_api.Err{Code: 503, Text: "DRAINING"}
+	}
+	return "OK", nil
+}
+
+func (s *httpServer) doInfo(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	return struct {
+		Version string `json:"version"`
+		Phase   string `json:"phase"`
+	}{
+		Version: version.Binary,
+		Phase:   s.nsqlookupd.ShutdownPhase().String(),
+	}, nil
+}
+
+// DB的大小和被配额拒绝的次数
+func (s *httpServer) doStats(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	err := s.checkAdminAll(req)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"registrations":  s.nsqlookupd.DB.Stats(),
+		"quota_exceeded": s.nsqlookupd.quotaMetrics.snapshot(),
+	}, nil
+}
+
+func (s *httpServer) doTopics(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclConsumer)
+	if err != nil {
+		return nil, err
+	}
+	topics := s.nsqlookupd.DB.FindRegistrations(ns, "topic", "*", "").Keys()
+	return map[string]interface{}{
+		"topics": topics,
+	}, nil
+}
+
+func (s *httpServer) doChannels(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclConsumer)
+	if err != nil {
+		return nil, err
+	}
+	topicName, err := s.getTopicArg(req)
+	if err != nil {
+		return nil, err
+	}
+	channels := s.nsqlookupd.DB.FindRegistrations(ns, "channel", topicName, "*").SubKeys()
+	return map[string]interface{}{
+		"channels": channels,
+	}, nil
+}
+
+// 根据topic查找nsqd, selector参数可以按label筛选,比如 ?topic=test&selector=env=prod,tier!=batch
+// order=load 按负载排序, include_stats=true 返回每个nsqd上报的负载
+func (s *httpServer) doLookup(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclConsumer)
+	if err != nil {
+		return nil, err
+	}
+	topicName, err := s.getTopicArg(req)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := getSelectorArg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	registration := s.nsqlookupd.DB.FindRegistrations(ns, "topic", topicName, "")
+	if len(registration) == 0 {
+		return nil, http_api.Err{Code: 404, Text: "TOPIC_NOT_FOUND"}
+	}
+
+	channels := s.nsqlookupd.DB.FindRegistrations(ns, "channel", topicName, "*").SubKeys()
+	producers := s.nsqlookupd.DB.FindProducers(ns, "topic", topicName, "", selector)
+	producers = producers.FilterByActive(s.nsqlookupd.live().InactiveProducerTimeout,
+		s.nsqlookupd.live().TombstoneLifetime).FilterByHealthy()
+
+	// order=load 按nsqd上报的负载从低到高返回, 默认是随机顺序
+	switch req.URL.Query().Get("order") {
+	case "", "random":
+		producers = producers.Shuffle()
+	case "load":
+		producers = producers.OrderByLoad(s.nsqlookupd.live().InactiveProducerTimeout)
+	default:
+		return nil, http_api.Err{Code: 400, Text: "INVALID_ARG_ORDER"}
+	}
+
+	if includeStats, _ := strconv.ParseBool(req.URL.Query().Get("include_stats")); includeStats {
+		return map[string]interface{}{
+			"channels":  channels,
+			"producers": producers.peerInfoWithStats(),
+		}, nil
+	}
+	return map[string]interface{}{
+		"channels":  channels,
+		"producers": producers.PeerInfo(),
+	}, nil
+}
+
+type node struct {
+	NodeID           string            `json:"node_id,omitempty"`
+	RemoteAddress    string            `json:"remote_address"`
+	Hostname         string            `json:"hostname"`
+	BroadcastAddress string            `json:"broadcast_address"`
+	TCPPort          int               `json:"tcp_port"`
+	HTTPPort         int               `json:"http_port"`
+	Version          string            `json:"version"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Static           bool              `json:"static"`  // 配置里写死的producer
+	Healthy          bool              `json:"healthy"` // 健康检查的结果, 没开健康检查的时候一直是true
+	Draining         bool              `json:"draining"`
+	Tombstones       []bool            `json:"tombstones"`
+	Topics           []string          `json:"topics"`
+}
+
+// 列出所有活跃的nsqd,以及每个nsqd上的topic
+func (s *httpServer) doNodes(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclConsumer)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := getSelectorArg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// "client"的Registration里面是所有IDENTIFY过的nsqd
+	producers := s.nsqlookupd.DB.FindProducers(ns, "client", "", "", selector).FilterByActive(
+		s.nsqlookupd.live().InactiveProducerTimeout, 0)
+	nodes := make([]*node, len(producers))
+	for i, p := range producers {
+		topics := s.nsqlookupd.DB.LookupRegistrations(p.peerInfo.id).Filter("topic", "*", "").Keys()
+
+		// 每个topic对应的producer是否被tombstone了
+		tombstones := make([]bool, len(topics))
+		for j, t := range topics {
+			topicProducers := s.nsqlookupd.DB.FindProducers(ns, "topic", t, "", nil)
+			for _, tp := range topicProducers {
+				if tp.peerInfo == p.peerInfo {
+					tombstones[j] = tp.IsTombstoned(s.nsqlookupd.live().TombstoneLifetime)
+				}
+			}
+		}
+
+		nodes[i] = &node{
+			NodeID:           p.peerInfo.NodeID,
+			RemoteAddress:    p.peerInfo.RemoteAddress,
+			Hostname:         p.peerInfo.Hostname,
+			BroadcastAddress: p.peerInfo.BroadcastAddress,
+			TCPPort:          p.peerInfo.TCPPort,
+			HTTPPort:         p.peerInfo.HTTPPort,
+			Version:          p.peerInfo.Version,
+			Labels:           p.peerInfo.Labels,
+			Static:           p.peerInfo.static,
+			Healthy:          p.peerInfo.IsHealthy(),
+			Draining:         p.peerInfo.IsDraining(),
+			Tombstones:       tombstones,
+			Topics:           topics,
+		}
+	}
+	return map[string]interface{}{
+		"producers": nodes,
+	}, nil
+}
+
+func (s *httpServer) doCreateTopic(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclAdmin)
+	if err != nil {
+		return nil, err
+	}
+	topicName, err := s.getTopicArg(req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkNewTopicChan(topicName, "")
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := getTTLArg(req)
+	if err != nil {
+		return nil, err
+	}
+	s.nsqlookupd.logf(LOG_INFO, "DB: adding topic(%s)", topicName)
+	key := Registration{ns, "topic", topicName, ""}
+	if _, qerr := s.nsqlookupd.addWithQuota([]Registration{key}, nil, ttl); qerr != nil {
+		s.nsqlookupd.logf(LOG_WARN, "DB: adding topic(%s) rejected - %s", topicName, qerr)
+		return nil, http_api.Err{Code: 403, Text: "QUOTA_EXCEEDED"}
+	}
+	s.nsqlookupd.audit(AuditCreateTopic, req.RemoteAddr, nil, key)
+	return nil, nil
+}
+
+func (s *httpServer) doDeleteTopic(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclAdmin)
+	if err != nil {
+		return nil, err
+	}
+	topicName, err := s.getTopicArg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// topic删除了,下面的channel也要一起删,放在一个事务里
+	var channels, topics Registrations
+	s.nsqlookupd.DB.Update(func(tx *RegistrationTx) {
+		channels = tx.FindRegistrations(ns, "channel", topicName, "*")
+		topics = tx.FindRegistrations(ns, "topic", topicName, "")
+		for _, registration := range append(channels, topics...) {
+			tx.RemoveRegistration(registration)
+		}
+	})
+	for _, registration := range channels {
+		s.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", registration.SubKey, topicName)
+		s.nsqlookupd.audit(AuditDeleteChannel, req.RemoteAddr, nil, registration)
+	}
+	for _, registration := range topics {
+		s.nsqlookupd.logf(LOG_INFO, "DB: removing topic(%s)", topicName)
+		s.nsqlookupd.audit(AuditDeleteTopic, req.RemoteAddr, nil, registration)
+	}
+	return nil, nil
+}
+
+// 把某个nsqd上的topic标记为tombstone, TombstoneLifetime时间内lookup的时候不会返回它
+// node参数格式是 broadcast_address:http_port
+func (s *httpServer) doTombstoneTopicProducer(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclAdmin)
+	if err != nil {
+		return nil, err
+	}
+	topicName, err := s.getTopicArg(req)
+	if err != nil {
+		return nil, err
+	}
+	node := req.URL.Query().Get("node")
+	if node == "" {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_NODE"}
+	}
+
+	s.nsqlookupd.logf(LOG_INFO, "DB: setting tombstone for producer@%s of topic(%s)", node, topicName)
+	producers := s.nsqlookupd.DB.FindProducers(ns, "topic", topicName, "", nil)
+	for _, p := range producers {
+		thisNode := fmt.Sprintf("%s:%d", p.peerInfo.BroadcastAddress, p.peerInfo.HTTPPort)
+		if thisNode == node {
+			p.Tombstone()
+			s.nsqlookupd.audit(AuditTombstone, req.RemoteAddr, p.peerInfo, Registration{ns, "topic", topicName, ""})
+		}
+	}
+	return nil, nil
+}
+
+// 把整个nsqd从lookup结果中摘掉, node参数格式是 broadcast_address:http_port
+// 节点现在没连着也可以drain, 连上来之后就是drain的状态
+func (s *httpServer) doDrainNode(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	return s.setNodeDraining(req, true)
+}
+
+func (s *httpServer) doUndrainNode(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	return s.setNodeDraining(req, false)
+}
+
+func (s *httpServer) setNodeDraining(req *http.Request, draining bool) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclAdmin)
+	if err != nil {
+		return nil, err
+	}
+	node := req.URL.Query().Get("node")
+	if node == "" {
+		return nil, http_api.Err{Code: 400, Text: "MISSING_ARG_NODE"}
+	}
+	op := AuditDrain
+	if !draining {
+		op = AuditUndrain
+	}
+
+	s.nsqlookupd.logf(LOG_INFO, "DB: %s node %s", strings.ToLower(op), node)
+	matched := s.nsqlookupd.setNodeDraining(ns, node, draining)
+	for _, peerInfo := range matched {
+		s.nsqlookupd.audit(op, req.RemoteAddr, peerInfo, Registration{ns, "client", "", ""})
+	}
+	return map[string]interface{}{
+		"node":     node,
+		"draining": draining,
+		"matched":  len(matched),
+	}, nil
+}
+
+func (s *httpServer) doCreateChannel(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclAdmin)
+	if err != nil {
+		return nil, err
+	}
+	topicName, channelName, err := s.getTopicChanArgs(req)
+	if err != nil {
+		return nil, err
+	}
+	err = s.checkNewTopicChan(topicName, channelName)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := getTTLArg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.nsqlookupd.logf(LOG_INFO, "DB: adding channel(%s) in topic(%s)", channelName, topicName)
+	channelKey := Registration{ns, "channel", topicName, channelName}
+	topicKey := Registration{ns, "topic", topicName, ""}
+	if _, qerr := s.nsqlookupd.addWithQuota([]Registration{channelKey, topicKey}, nil, ttl); qerr != nil {
+		s.nsqlookupd.logf(LOG_WARN, "DB: adding channel(%s) in topic(%s) rejected - %s", channelName, topicName, qerr)
+		return nil, http_api.Err{Code: 403, Text: "QUOTA_EXCEEDED"}
+	}
+	s.nsqlookupd.audit(AuditCreateChannel, req.RemoteAddr, nil, channelKey)
+	s.nsqlookupd.audit(AuditCreateTopic, req.RemoteAddr, nil, topicKey)
+	return nil, nil
+}
+
+func (s *httpServer) doDeleteChannel(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	ns, err := s.getNamespace(req, aclAdmin)
+	if err != nil {
+		return nil, err
+	}
+	topicName, channelName, err := s.getTopicChanArgs(req)
+	if err != nil {
+		return nil, err
+	}
+
+	registrations := s.nsqlookupd.DB.FindRegistrations(ns, "channel", topicName, channelName)
+	if len(registrations) == 0 {
+		return nil, http_api.Err{Code: 404, Text: "CHANNEL_NOT_FOUND"}
+	}
+
+	s.nsqlookupd.logf(LOG_INFO, "DB: removing channel(%s) from topic(%s)", channelName, topicName)
+	for _, registration := range registrations {
+		s.nsqlookupd.DB.RemoveRegistration(registration)
+		s.nsqlookupd.audit(AuditDeleteChannel, req.RemoteAddr, nil, registration)
+	}
+	return nil, nil
+}
+
+// 查询审计日志, 可以按topic或者node(peer id 或者 broadcast_address:http_port)过滤
+// limit 限制返回条数, 默认100条, 从新到旧排列
+func (s *httpServer) doAudit(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	err := s.checkAdminAll(req)
+	if err != nil {
+		return nil, err
+	}
+	if s.nsqlookupd.auditLog == nil {
+		return nil, http_api.Err{Code: 404, Text: "AUDIT_LOG_DISABLED"}
+	}
+	limit := 100
+	if v := req.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, http_api.Err{Code: 400, Text: "INVALID_ARG_LIMIT"}
+		}
+	}
+	events := s.nsqlookupd.auditLog.Query(req.URL.Query().Get("topic"), req.URL.Query().Get("node"), limit)
+	return map[string]interface{}{
+		"events": events,
+	}, nil
+}
+
+// GET 导出整个DB, POST 导入, mode参数是merge(默认)或者replace
+func (s *httpServer) doRegistrations(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	err := s.checkAdminAll(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method == "GET" {
+		return s.nsqlookupd.DB.Export(), nil
+	}
+
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ImportMerge
+	}
+	if mode != ImportMerge && mode != ImportReplace {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_ARG_MODE"}
+	}
+	var dump RegistrationDump
+	err = json.NewDecoder(req.Body).Decode(&dump)
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_BODY", Reason: err.Error()}
+	}
+	err = dump.validate(s.nsqlookupd.live().namePolicy)
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_BODY", Reason: err.Error()}
+	}
+
+	res, added := s.nsqlookupd.DB.Import(&dump, mode)
+	s.nsqlookupd.logf(LOG_INFO, "DB: imported %d registrations and %d producers (%s, %d removed)",
+		res.Registrations, res.Producers, mode, res.Removed)
+	for _, k := range added {
+		s.nsqlookupd.audit(AuditImport, req.RemoteAddr, nil, k)
+	}
+	return res, nil
+}
+
+// 从query参数或者X-NSQ-Namespace头中获取namespace, 都没有就是默认namespace
+// 同时检查这个请求有没有权限在这个namespace里做role对应的操作
+func (s *httpServer) getNamespace(req *http.Request, role string) (string, error) {
+	ns := req.URL.Query().Get("namespace")
+	if ns == "" {
+		ns = req.Header.Get(NamespaceHeader)
+	}
+	if !isValidNamespace(ns) {
+		return "", http_api.Err{Code: 400, Text: "INVALID_ARG_NAMESPACE"}
+	}
+	if !s.nsqlookupd.checkNamespaceACL(ns, role, bearerToken(req)) {
+		return "", http_api.Err{Code: 403, Text: "FORBIDDEN"}
+	}
+	return ns, nil
+}
+
+// 跨namespace的操作(导入导出整个DB, 审计日志, 统计)要求在所有配置了ACL的namespace里都是admin
+func (s *httpServer) checkAdminAll(req *http.Request) error {
+	token := bearerToken(req)
+	for ns := range s.nsqlookupd.live().namespaceACLs {
+		if !s.nsqlookupd.checkNamespaceACL(ns, aclAdmin, token) {
+			return http_api.Err{Code: 403, Text: "FORBIDDEN"}
+		}
+	}
+	return nil
+}
+
+// 重新读配置文件, 返回配置的变化; 配置被拒绝的时候reason里是变化和原因
+func (s *httpServer) doReloadConfig(w http.ResponseWriter, req *http.Request) (interface{}, error) {
+	err := s.checkAdminAll(req)
+	if err != nil {
+		return nil, err
+	}
+	report, err := s.nsqlookupd.ReloadConfig()
+	if err == ErrReloadDisabled {
+		return nil, http_api.Err{Code: 501, Text: "RELOAD_DISABLED"}
+	}
+	if err != nil {
+		reason := err.Error()
+		if report != nil {
+			reason = report.String()
+		}
+		return nil, http_api.Err{Code: 400, Text: "INVALID_CONFIG", Reason: reason}
+	}
+	return report, nil
+}
+
+func bearerToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// 从query参数中获取topic, 这里只检查名字的长度和字符, 名字不合法的时候reason里是具体原因
+func (s *httpServer) getTopicArg(req *http.Request) (string, error) {
+	topicName := req.URL.Query().Get("topic")
+	if topicName == "" {
+		return "", http_api.Err{Code: 400, Text: "MISSING_ARG_TOPIC"}
+	}
+	if err := s.nsqlookupd.live().namePolicy.ValidateSyntax(topicName); err != nil {
+		return "", http_api.Err{Code: 400, Text: "INVALID_ARG_TOPIC", Reason: err.Error()}
+	}
+	return topicName, nil
+}
+
+// 从query参数中获取topic和channel
+func (s *httpServer) getTopicChanArgs(req *http.Request) (string, string, error) {
+	topicName, err := s.getTopicArg(req)
+	if err != nil {
+		return "", "", err
+	}
+	channelName := req.URL.Query().Get("channel")
+	if channelName == "" {
+		return "", "", http_api.Err{Code: 400, Text: "MISSING_ARG_CHANNEL"}
+	}
+	if err := s.nsqlookupd.live().namePolicy.ValidateSyntax(channelName); err != nil {
+		return "", "", http_api.Err{Code: 400, Text: "INVALID_ARG_CHANNEL", Reason: err.Error()}
+	}
+	return topicName, channelName, nil
+}
+
+// 创建topic/channel的时候再检查保留名字和#ephemeral, channelName为空表示只创建topic
+func (s *httpServer) checkNewTopicChan(topicName string, channelName string) error {
+	policy := s.nsqlookupd.live().namePolicy
+	if err := policy.ValidateTopicName(topicName); err != nil {
+		return http_api.Err{Code: 400, Text: "INVALID_ARG_TOPIC", Reason: err.Error()}
+	}
+	if channelName != "" {
+		if err := policy.ValidateChannelName(channelName); err != nil {
+			return http_api.Err{Code: 400, Text: "INVALID_ARG_CHANNEL", Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// 从query参数中获取ttl, 没有的话返回0, 表示一直保留
+func getTTLArg(req *http.Request) (time.Duration, error) {
+	v := req.URL.Query().Get("ttl")
+	if v == "" {
+		return 0, nil
+	}
+	ttl, err := parseTTL(v)
+	if err != nil {
+		return 0, http_api.Err{Code: 400, Text: "INVALID_ARG_TTL", Reason: err.Error()}
+	}
+	return ttl, nil
+}
+
+// 从query参数中获取selector,没有的话返回空Selector
+func getSelectorArg(req *http.Request) (Selector, error) {
+	selector, err := ParseSelector(req.URL.Query().Get("selector"))
+	if err != nil {
+		return nil, http_api.Err{Code: 400, Text: "INVALID_ARG_SELECTOR"}
+	}
+	return selector, nil
+}
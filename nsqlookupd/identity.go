@@ -0,0 +1,112 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// nsqd的身份不再用TCP连接的地址, 重连之后端口变了也还是同一个producer
+// IDENTIFY可以带上node_id, 没带的话用 broadcast_address:tcp_port:http_port
+// PeerInfo.id 是 namespace/node_id, 同一个nsqd在不同namespace里是不同的producer
+// 同一个id又连上来一个连接的时候, 新连接接管旧连接的所有Registration, 旧连接被断开
+// 所以两个不同的nsqd不能用同一个node_id, 不然会互相把对方顶掉
+// 重启之后的nsqd可能已经没有某些topic了, 接管过来的Registration在InactiveProducerTimeout之内
+// 没有重新REGISTER的话由reaper删掉
+
+const nodeIDMaxLength = 255
+
+// node_id 不能有空白和/(namespace的分隔符), static:开头的留给静态producer
+func validateNodeID(nodeID string) error {
+	if len(nodeID) > nodeIDMaxLength {
+		return fmt.Errorf("node_id is longer than %d characters", nodeIDMaxLength)
+	}
+	if strings.ContainsAny(nodeID, " \t\r\n/") {
+		return fmt.Errorf("node_id must not contain whitespace or '/'")
+	}
+	if strings.HasPrefix(nodeID, "static:") {
+		return fmt.Errorf("node_id must not start with \"static:\"")
+	}
+	return nil
+}
+
+// IDENTIFY没带node_id的时候用的
+func (p *PeerInfo) deriveNodeID() string {
+	return net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort)) + ":" + strconv.Itoa(p.HTTPPort)
+}
+
+func peerID(namespace string, nodeID string) string {
+	if namespace != "" {
+		return namespace + "/" + nodeID
+	}
+	return nodeID
+}
+
+// 被新连接替换掉了, 旧连接之后的修改都不能再生效
+func (p *PeerInfo) isReplaced() bool {
+	return atomic.LoadInt32(&p.replaced) == 1
+}
+
+// ReplacePeer 把同一个id的旧PeerInfo换成peerInfo, Registration和tombstone都保留
+// 返回被替换掉的PeerInfo, 没有的话返回nil
+func (tx *RegistrationTx) ReplacePeer(peerInfo *PeerInfo) *PeerInfo {
+	return tx.db.replacePeer(peerInfo)
+}
+
+// 调用方要持有写锁
+// 读Producer的时候是不持有锁的, 不能修改已经在DB里的Producer, 换成新的Producer
+func (r *RegistrationDB) replacePeer(peerInfo *PeerInfo) *PeerInfo {
+	var old *PeerInfo
+	now := time.Now()
+	for _, k := range r.lookupRegistrations(peerInfo.id) {
+		p := r.registrationMap[k][peerInfo.id]
+		if p.peerInfo == peerInfo || p.peerInfo.static {
+			continue
+		}
+		old = p.peerInfo
+		np := p.clone(peerInfo)
+		np.inheritedAt = now
+		r.registrationMap[k][peerInfo.id] = np
+	}
+	if old != nil {
+		atomic.StoreInt32(&old.replaced, 1)
+	}
+	return old
+}
+
+// 换一个PeerInfo, tombstone和负载信息保留
+func (p *Producer) clone(peerInfo *PeerInfo) *Producer {
+	np := &Producer{
+		tombstoneAt: atomic.LoadInt64(&p.tombstoneAt),
+		peerInfo:    peerInfo,
+	}
+	if stats := p.Stats(); stats != nil {
+		np.SetStats(stats)
+	}
+	return np
+}
+
+// 接管或者导入之后一直没有重新REGISTER, 被reaper删掉的producer
+type inheritedProducer struct {
+	Registration
+	peerInfo *PeerInfo
+}
+
+// ExpireInheritedProducers 删掉before之前接管过来或者导入的, 到现在还没有重新REGISTER的producer
+func (tx *RegistrationTx) ExpireInheritedProducers(before time.Time) []inheritedProducer {
+	var expired []inheritedProducer
+	for k, producers := range tx.db.registrationMap {
+		for _, p := range producers {
+			if !p.inheritedAt.IsZero() && p.inheritedAt.Before(before) {
+				expired = append(expired, inheritedProducer{k, p.peerInfo})
+			}
+		}
+	}
+	for _, e := range expired {
+		tx.ReleaseProducer(e.Registration, e.peerInfo.id)
+	}
+	return expired
+}
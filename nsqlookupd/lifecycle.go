@@ -0,0 +1,138 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"time"
+)
+
+// Registration的生命周期: 最后一个producer离开之后过多久把Registration删掉
+// 默认Registration一直保留, 直到被管理接口删掉
+// 带#ephemeral后缀的相当于TTL为0, 最后一个producer离开马上删
+// REGISTER的时候带上 ttl=30s 或者管理接口创建的时候带上ttl参数, 没有producer超过TTL之后由reaper删掉
+// 静态producer不会离开, 它注册的Registration也就不会过期
+type lifecycle struct {
+	ttl        time.Duration
+	emptySince time.Time // 最后一个producer离开的时间, 有producer的时候是零值
+}
+
+func (lc *lifecycle) expired(now time.Time) bool {
+	return !lc.emptySince.IsZero() && now.Sub(lc.emptySince) >= lc.ttl
+}
+
+// 解析REGISTER和管理接口的ttl参数
+func parseTTL(s string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive")
+	}
+	return ttl, nil
+}
+
+// 调用方要持有写锁
+// #ephemeral的Registration创建的时候不算空的, 和以前一样要等producer离开
+func (r *RegistrationDB) initLifecycle(k Registration) {
+	if k.IsEphemeral() {
+		r.lifecycles[k] = &lifecycle{}
+	}
+}
+
+// 调用方要持有写锁
+// 覆盖原来的TTL, 包括#ephemeral默认的0; 现在没有producer的话从现在开始算
+func (r *RegistrationDB) setTTL(k Registration, ttl time.Duration) {
+	producers, ok := r.registrationMap[k]
+	if !ok {
+		return
+	}
+	lc := &lifecycle{ttl: ttl}
+	if len(producers) == 0 {
+		lc.emptySince = time.Now()
+	}
+	r.lifecycles[k] = lc
+}
+
+// 调用方要持有写锁, producer数量变了之后调用
+func (r *RegistrationDB) touchLifecycle(k Registration) {
+	lc, ok := r.lifecycles[k]
+	if !ok {
+		return
+	}
+	if len(r.registrationMap[k]) > 0 {
+		lc.emptySince = time.Time{}
+	} else if lc.emptySince.IsZero() {
+		lc.emptySince = time.Now()
+	}
+}
+
+// TTL 返回Registration的TTL, 没有设置过的返回false
+func (r *RegistrationDB) TTL(k Registration) (time.Duration, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	lc, ok := r.lifecycles[k]
+	if !ok {
+		return 0, false
+	}
+	return lc.ttl, true
+}
+
+// SetTTL Registration不存在的时候什么都不做, 要和注册放在同一个事务里
+func (tx *RegistrationTx) SetTTL(k Registration, ttl time.Duration) {
+	tx.db.setTTL(k, ttl)
+}
+
+// ReleaseProducer 删除producer, 按生命周期马上删掉已经过期的Registration(#ephemeral)
+// 设置了TTL的Registration交给reaper
+// 返回producer是不是删掉了, Registration是不是也一起删掉了
+func (tx *RegistrationTx) ReleaseProducer(k Registration, id string) (bool, bool) {
+	removed, left := tx.db.removeProducer(k, id)
+	if lc, ok := tx.db.lifecycles[k]; ok && removed && left == 0 && lc.expired(time.Now()) {
+		tx.db.removeRegistration(k)
+		return true, true
+	}
+	return removed, false
+}
+
+// ExpireRegistrations 删掉所有没有producer超过TTL的Registration
+func (tx *RegistrationTx) ExpireRegistrations(now time.Time) Registrations {
+	expired := Registrations{}
+	for k, lc := range tx.db.lifecycles {
+		if lc.expired(now) && len(tx.db.registrationMap[k]) == 0 {
+			expired = append(expired, k)
+		}
+	}
+	for _, k := range expired {
+		tx.db.removeRegistration(k)
+	}
+	return expired
+}
+
+// 定时清理过期的Registration, 和接管或者导入之后没有重新REGISTER的producer
+func (l *NSQLookupd) reapLoop() {
+	ticker := time.NewTicker(l.opts.RegistrationReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			var expired Registrations
+			var inherited []inheritedProducer
+			l.DB.Update(func(tx *RegistrationTx) {
+				inherited = tx.ExpireInheritedProducers(now.Add(-l.live().InactiveProducerTimeout))
+				expired = tx.ExpireRegistrations(now)
+			})
+			for _, e := range inherited {
+				l.logf(LOG_INFO, "DB: node %s did not re-register category:%s key:%s subkey:%s after reconnecting or import",
+					e.peerInfo.id, e.Category, e.Key, e.SubKey)
+				l.audit(AuditUnregister, "", e.peerInfo, e.Registration)
+			}
+			for _, k := range expired {
+				l.logf(LOG_INFO, "DB: expired category:%s key:%s subkey:%s", k.Category, k.Key, k.SubKey)
+				l.audit(AuditExpire, "", nil, k)
+			}
+		case <-l.reapExitChan:
+			l.logf(LOG_INFO, "REAPER: closing")
+			return
+		}
+	}
+}
@@ -13,5 +13,5 @@ const (
 )
 
 func (n *NSQLookupd) logf(level lg.LogLevel, f string, args ...interface{}) {
-	lg.Logf(n.opts.Logger, n.opts.LogLever, level, f, args)
+	lg.Logf(n.opts.Logger, n.live().LogLever, level, f, args...)
 }
@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/xswwhy/nsq/internal/protocol"
+	"github.com/xswwhy/nsq/internal/util"
 	"github.com/xswwhy/nsq/internal/version"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -75,22 +77,38 @@ func (p *LookupProtocolV1) IOLoop(c protocol.Client) error {
 	p.nsqlookupd.logf(LOG_INFO, "PROTOCOL(V1): [%s] exiting ioloop", client)
 
 	// nsqlookupd.DB 中删除该client
+	// 放在一个事务里面,别人不会看到这个nsqd只删了一部分Registration的状态
 	if client.peerInfo != nil {
-		registrations := p.nsqlookupd.DB.LookupRegistrations(client.peerInfo.id)
-		for _, r := range registrations {
-			if removed, _ := p.nsqlookupd.DB.RemoveProducer(r, client.peerInfo.id); removed {
-				p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTRATION category:%s key:%s subkey:%s",
-					client, r.Category, r.Key, r.SubKey)
+		var removedKeys Registrations
+		p.nsqlookupd.DB.Update(func(tx *RegistrationTx) {
+			// 被新连接替换了的话, 这些Registration已经是新连接的了
+			if client.peerInfo.isReplaced() {
+				return
 			}
+			for _, r := range tx.LookupRegistrations(client.peerInfo.id) {
+				if removed, _ := tx.RemoveProducer(r, client.peerInfo.id); removed {
+					removedKeys = append(removedKeys, r)
+				}
+			}
+		})
+		for _, r := range removedKeys {
+			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTRATION category:%s key:%s subkey:%s",
+				client, r.Category, r.Key, r.SubKey)
+			p.nsqlookupd.audit(AuditDisconnect, client.RemoteAddr().String(), client.peerInfo, r)
 		}
 	}
 	return err
 }
 
 // 处理client发来的数据
-// 支持4种操作 PING  IDENTIFY  REGISTER  UNREGISTER
+// 支持7种操作 PING  IDENTIFY  REGISTER  UNREGISTER  STATS  MREGISTER  MUNREGISTER
 // 一个nsqd过来要先 IDENTIFY 再 REGISTER
 func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	// 关闭的时候等正在执行的命令执行完, 之后的命令都不再执行
+	if !p.nsqlookupd.enterCommand() {
+		return nil, protocol.NewFatalClientErr(nil, "E_SHUTTING_DOWN", "nsqlookupd is shutting down")
+	}
+	defer p.nsqlookupd.leaveCommand()
 	switch params[0] {
 	case "PING":
 		return p.PING(client, params)
@@ -100,6 +118,12 @@ func (p *LookupProtocolV1) Exec(client *ClientV1, reader *bufio.Reader, params [
 		return p.REGISTER(client, reader, params[1:])
 	case "UNREGISTER":
 		return p.UNREGISTER(client, reader, params[1:])
+	case "STATS":
+		return p.STATS(client, reader, params[1:])
+	case "MREGISTER":
+		return p.MREGISTER(client, reader, params[1:])
+	case "MUNREGISTER":
+		return p.MUNREGISTER(client, reader, params[1:])
 	}
 	return nil, protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("invalid command %s", params[0]))
 }
@@ -122,42 +146,88 @@ func (p *LookupProtocolV1) IDENTIFY(client *ClientV1, reader *bufio.Reader, para
 		return nil, protocol.NewFatalClientErr(err, "E_INVALID", "cannot IDENTIFY again")
 	}
 
-	var bodyLen int32
-	err = binary.Read(reader, binary.BigEndian, bodyLen)
+	body, err := readBody("IDENTIFY", reader)
 	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body size")
-	}
-	body := make([]byte, bodyLen)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
-		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to read body")
+		return nil, err
 	}
 
 	// 获取到了网络配置信息(json格式),存一下
-	peerInfo := PeerInfo{id: client.RemoteAddr().String()}
+	peerInfo := PeerInfo{}
 	err = json.Unmarshal(body, &peerInfo)
 	if err != nil {
 		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY failed to decode JSON body")
 
 	}
-	peerInfo.RemoteAddress = client.RemoteAddr().String()
+	peerInfo.RemoteAddress = client.id
 	// peerInfo中的字段,一个都不能少
 	if peerInfo.BroadcastAddress == "" || peerInfo.TCPPort == 0 || peerInfo.HTTPPort == 0 || peerInfo.Version == "" {
 		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", "IDENTIFY missing fields")
 	}
+	// labels是可选的,但是有的话格式要对
+	if err := validateLabels(peerInfo.Labels); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY "+err.Error())
+	}
+	// namespace也是可选的, 配置了ACL的namespace要带上对的namespace_token
+	if !isValidNamespace(peerInfo.Namespace) {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", fmt.Sprintf("IDENTIFY invalid namespace '%s'", peerInfo.Namespace))
+	}
+	// node_id是可选的, 没有的话用地址和端口生成一个
+	if err := validateNodeID(peerInfo.NodeID); err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", "IDENTIFY "+err.Error())
+	}
+	if peerInfo.NodeID == "" {
+		peerInfo.NodeID = peerInfo.deriveNodeID()
+	}
+	peerInfo.id = peerID(peerInfo.Namespace, peerInfo.NodeID)
+	peerInfo.conn = client
+	var auth struct {
+		NamespaceToken string `json:"namespace_token"`
+	}
+	json.Unmarshal(body, &auth)
+	if !p.nsqlookupd.checkNamespaceACL(peerInfo.Namespace, aclProducer, auth.NamespaceToken) {
+		return nil, protocol.NewFatalClientErr(nil, "E_UNAUTHORIZED",
+			fmt.Sprintf("IDENTIFY not authorized for namespace '%s'", peerInfo.Namespace))
+	}
 	atomic.StoreInt64(&peerInfo.lastUpdate, time.Now().UnixNano())
-	p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): IDENTIFY Address:%s TCP:%d HTTP:%d Version:%s",
-		client, peerInfo.BroadcastAddress, peerInfo.TCPPort, peerInfo.HTTPPort, peerInfo.Version)
+	p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): IDENTIFY Node:%s Address:%s TCP:%d HTTP:%d Version:%s Labels:%v Namespace:%s",
+		client, peerInfo.NodeID, peerInfo.BroadcastAddress, peerInfo.TCPPort, peerInfo.HTTPPort, peerInfo.Version, peerInfo.Labels, peerInfo.Namespace)
 
 	client.peerInfo = &peerInfo
-	if p.nsqlookupd.DB.AddProducer(Registration{"client", "", ""}, &Producer{peerInfo: client.peerInfo}) {
+	key := Registration{peerInfo.Namespace, "client", "", ""}
+	// 同一个id已经有连接了(nsqd重连的时候旧连接还没超时断开), 新连接接管它的Registration
+	// 接管和注册在一个事务里, 别人不会看到这个nsqd消失了一下
+	var old *PeerInfo
+	var added, drained bool
+	p.nsqlookupd.DB.Update(func(tx *RegistrationTx) {
+		// 维护期间重启的nsqd, 重新连上来之后还是drain的状态
+		// 和setNodeDraining一样在事务里检查, 不会在检查之后注册之前被drain而漏掉
+		drained = p.nsqlookupd.isNodeDrained(peerInfo.Namespace, peerInfo.node())
+		if drained {
+			client.peerInfo.setDraining(true)
+		}
+		old = tx.ReplacePeer(client.peerInfo)
+		added = tx.AddProducer(key, &Producer{peerInfo: client.peerInfo})
+	})
+	if drained {
+		p.nsqlookupd.logf(LOG_INFO, "CLIENT(%s): node %s is drained", client, peerInfo.node())
+	}
+	if old != nil {
+		p.nsqlookupd.logf(LOG_WARN, "CLIENT(%s): node %s replaces connection from %s", client, peerInfo.id, old.RemoteAddress)
+		p.nsqlookupd.audit(AuditReplace, client.RemoteAddr().String(), client.peerInfo, key)
+		if old.conn != nil {
+			old.conn.Close()
+		}
+	}
+	if added {
 		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s", client, "client", "", "")
+		p.nsqlookupd.audit(AuditIdentify, client.RemoteAddr().String(), client.peerInfo, key)
 	}
 
 	// nsqlookupd给nsqd发送自己的网络配置信息
 	data := make(map[string]interface{})
-	data["tcp_port"] = p.nsqlookupd.RealTCPAddr().Port
-	data["http_port"] = p.nsqlookupd.RealHTTPAddr().Port
+	// 监听unix socket的时候没有端口, 返回0
+	data["tcp_port"] = util.AddrPort(p.nsqlookupd.TCPListenAddr())
+	data["http_port"] = util.AddrPort(p.nsqlookupd.HTTPListenAddr())
 	data["version"] = version.Binary
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -177,7 +247,18 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 	if client.peerInfo == nil {
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
 	}
-	topic, channel, err := getTopicChan("REGISTER", params)
+	// REGISTER topic [channel] [ttl=30s]
+	args, options := splitOptions(params)
+	policy := p.nsqlookupd.live().namePolicy
+	topic, channel, err := getTopicChan(policy, "REGISTER", args)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNewTopicChan(policy, "REGISTER", topic, channel)
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := getTTLOption("REGISTER", options)
 	if err != nil {
 		return nil, err
 	}
@@ -186,66 +267,309 @@ func (p *LookupProtocolV1) REGISTER(client *ClientV1, reader *bufio.Reader, para
 	// topic 对应NSQLookupd.DB中Registration中的Key
 	// channel 对应NSQLookupd.DB中Registration中的SubKey
 	// FIXME: 从代码上看,Registration中Category是固定写死的
+	ns := client.peerInfo.Namespace
+	var keys []Registration
 	if channel != "" {
-		key := Registration{"channel", topic, channel}
-		if p.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
+		keys = append(keys, Registration{ns, "channel", topic, channel})
+	}
+	keys = append(keys, Registration{ns, "topic", topic, ""})
+
+	// 超过配额不是致命错误, nsqd可以继续注册别的
+	// TTL设置在最具体的那个Registration上: 有channel就是channel, 没有就是topic
+	added, qerr := p.nsqlookupd.addWithQuota(keys, client.peerInfo, ttl)
+	if qerr != nil {
+		p.nsqlookupd.logf(LOG_WARN, "DB: client(%s) REGISTER topic:%s channel:%s rejected - %s", client, topic, channel, qerr)
+		return nil, protocol.NewClientErr(qerr, "E_QUOTA_EXCEEDED", fmt.Sprintf("REGISTER %s", qerr))
+	}
+	for i, k := range keys {
+		if added[i] {
 			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
-				client, "channel", topic, channel)
+				client, k.Category, k.Key, k.SubKey)
+			p.nsqlookupd.audit(AuditRegister, client.RemoteAddr().String(), client.peerInfo, k)
 		}
 	}
-	key := Registration{"topic", topic, ""}
-	if p.nsqlookupd.DB.AddProducer(key, &Producer{peerInfo: client.peerInfo}) {
-		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
-			client, "topic", topic, "")
-	}
 	return []byte("OK"), nil
 }
 
+// UNREGISTER 返回真正删掉了的Registration列表: [{"category":"channel","topic":"xx","channel":"xx","deleted":true}, ...]
+// deleted表示Registration本身也删掉了(#ephemeral), 否则只是删掉了这个nsqd
 func (p *LookupProtocolV1) UNREGISTER(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
 	if client.peerInfo == nil {
 		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
 	}
-	topic, channel, err := getTopicChan("UNREGISTER", params)
+	topic, channel, err := getTopicChan(p.nsqlookupd.live().namePolicy, "UNREGISTER", params)
 	if err != nil {
 		return nil, err
 	}
-	if channel != "" {
-		k := Registration{"channel", topic, channel}
-		removed, left := p.nsqlookupd.DB.RemoveProducer(k, client.peerInfo.id)
-		if removed {
-			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
-				client, "channel", topic, channel)
+	ns := client.peerInfo.Namespace
+	keys := Registrations{Registration{ns, "channel", topic, channel}}
+	removedList := []unregisterResult{}
+	p.nsqlookupd.DB.Update(func(tx *RegistrationTx) {
+		if client.peerInfo.isReplaced() {
+			return
+		}
+		if channel == "" {
+			// 没有channel的时候,表示同一topic下的所有channel都删, 最后再删topic
+			keys = tx.FindRegistrations(ns, "channel", topic, "*")
+			sort.Slice(keys, func(i, j int) bool { return keys[i].SubKey < keys[j].SubKey })
+			keys = append(keys, Registration{ns, "topic", topic, ""})
 		}
 		// 有#ephemeral 标记的topic 或者 channel, Registration为空的时候,连Registration也删
-		if left == 0 && strings.HasSuffix(channel, "#ephemeral") {
-			p.nsqlookupd.DB.RemoveRegistration(k)
+		for _, k := range keys {
+			if removed, deleted := tx.ReleaseProducer(k, client.peerInfo.id); removed {
+				removedList = append(removedList, unregisterResult{k.Category, k.Key, k.SubKey, deleted})
+			}
+		}
+	})
+	for _, r := range removedList {
+		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s deleted:%t",
+			client, r.Category, r.Topic, r.Channel, r.Deleted)
+		p.nsqlookupd.audit(AuditUnregister, client.RemoteAddr().String(), client.peerInfo, Registration{ns, r.Category, r.Topic, r.Channel})
+	}
+	response, err := json.Marshal(removedList)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_INTERNAL", "failed to encode JSON response")
+	}
+	return response, nil
+}
+
+// UNREGISTER 返回的每一项
+type unregisterResult struct {
+	Category string `json:"category"`
+	Topic    string `json:"topic"`
+	Channel  string `json:"channel,omitempty"`
+	Deleted  bool   `json:"deleted"`
+}
+
+// MREGISTER MUNREGISTER 的body中的一项
+// TTL 只有MREGISTER支持, 和REGISTER的ttl参数一样
+type batchItem struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+	TTL     string `json:"ttl,omitempty"`
+}
+
+// MREGISTER MUNREGISTER 返回的每一项的处理结果
+// Changed: MREGISTER表示有新注册的, MUNREGISTER表示真的删掉了
+type batchItemResult struct {
+	Topic   string `json:"topic"`
+	Channel string `json:"channel,omitempty"`
+	OK      bool   `json:"ok"`
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// 读取MREGISTER MUNREGISTER的body: [{"topic":"xx","channel":"xx"}, ...]
+func readBatchItems(command string, reader *bufio.Reader) ([]batchItem, error) {
+	body, err := readBody(command, reader)
+	if err != nil {
+		return nil, err
+	}
+	var items []batchItem
+	err = json.Unmarshal(body, &items)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_BAD_BODY", fmt.Sprintf("%s failed to decode JSON body", command))
+	}
+	return items, nil
+}
+
+// 一次注册多个topic/channel, nsqd启动的时候topic很多,一个一个REGISTER太慢了
+// 所有的Registration在一次加锁中完成,名字不合法的项单独报错,不影响其他项
+func (p *LookupProtocolV1) MREGISTER(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+	items, err := readBatchItems("MREGISTER", reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := client.peerInfo.Namespace
+	results := make([]batchItemResult, len(items))
+	for i, item := range items {
+		results[i] = batchItemResult{Topic: item.Topic, Channel: item.Channel}
+		if err := validateBatchItem(p.nsqlookupd.live().namePolicy, "MREGISTER", item); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].OK = true
+	}
+
+	// 每一项单独检查配额, 超过配额的项报错, 前面的项已经注册了的不受影响
+	var addedKeys Registrations
+	p.nsqlookupd.DB.Update(func(tx *RegistrationTx) {
+		for i, item := range items {
+			if !results[i].OK {
+				continue
+			}
+			var keys []Registration
+			if item.Channel != "" {
+				keys = append(keys, Registration{ns, "channel", item.Topic, item.Channel})
+			}
+			keys = append(keys, Registration{ns, "topic", item.Topic, ""})
+			if qerr := p.nsqlookupd.checkQuota(tx, keys, client.peerInfo); qerr != nil {
+				results[i].OK = false
+				results[i].Error = "E_QUOTA_EXCEEDED MREGISTER " + qerr.Error()
+				continue
+			}
+			for _, k := range keys {
+				if tx.AddProducer(k, &Producer{peerInfo: client.peerInfo}) {
+					results[i].Changed = true
+					addedKeys = append(addedKeys, k)
+				}
+			}
+			if item.TTL != "" {
+				ttl, _ := parseTTL(item.TTL) // validateBatchItem里已经检查过了
+				tx.SetTTL(keys[0], ttl)
+			}
+		}
+	})
+	for _, k := range addedKeys {
+		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) REGISTER category:%s key:%s subkey:%s",
+			client, k.Category, k.Key, k.SubKey)
+		p.nsqlookupd.audit(AuditRegister, client.RemoteAddr().String(), client.peerInfo, k)
+	}
+	return marshalBatchResults(results)
+}
+
+// 一次取消注册多个topic/channel, 和UNREGISTER一样,没有channel的项表示该topic下所有channel都删
+func (p *LookupProtocolV1) MUNREGISTER(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+	items, err := readBatchItems("MUNREGISTER", reader)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]batchItemResult, len(items))
+	for i, item := range items {
+		results[i] = batchItemResult{Topic: item.Topic, Channel: item.Channel}
+		if err := validateBatchItem(p.nsqlookupd.live().namePolicy, "MUNREGISTER", item); err != nil {
+			results[i].Error = err.Error()
+			continue
 		}
-	} else {
-		// 没有channel的时候,表示同一topic下的所有channel都删
-		registrations := p.nsqlookupd.DB.FindRegistrations("channel", topic, "*")
-		for _, registration := range registrations {
-			removed, _ := p.nsqlookupd.DB.RemoveProducer(registration, client.peerInfo.id)
-			if removed {
-				p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
-					client, "topic", topic, "")
+		results[i].OK = true
+	}
+
+	// 查找topic下的channel和删除放在同一个事务里
+	ns := client.peerInfo.Namespace
+	var removedKeys Registrations
+	p.nsqlookupd.DB.Update(func(tx *RegistrationTx) {
+		if client.peerInfo.isReplaced() {
+			return
+		}
+		for i, item := range items {
+			if !results[i].OK {
+				continue
+			}
+			keys := Registrations{Registration{ns, "channel", item.Topic, item.Channel}}
+			if item.Channel == "" {
+				keys = append(tx.FindRegistrations(ns, "channel", item.Topic, "*"), Registration{ns, "topic", item.Topic, ""})
+			}
+			for _, k := range keys {
+				if removed, _ := tx.ReleaseProducer(k, client.peerInfo.id); removed {
+					results[i].Changed = true
+					removedKeys = append(removedKeys, k)
+				}
 			}
 		}
-		key := Registration{"topic", topic, ""}
-		removed, left := p.nsqlookupd.DB.RemoveProducer(key, client.peerInfo.id)
-		if removed {
-			p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
-				client, "topic", topic, "")
+	})
+	for _, k := range removedKeys {
+		p.nsqlookupd.logf(LOG_INFO, "DB: client(%s) UNREGISTER category:%s key:%s subkey:%s",
+			client, k.Category, k.Key, k.SubKey)
+		p.nsqlookupd.audit(AuditUnregister, client.RemoteAddr().String(), client.peerInfo, k)
+	}
+	return marshalBatchResults(results)
+}
+
+// IOLoop 要求返回的错误都是protocol.ChildErr, 所以json错误也要包一下
+func marshalBatchResults(results []batchItemResult) ([]byte, error) {
+	response, err := json.Marshal(results)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_INTERNAL", "failed to encode JSON response")
+	}
+	return response, nil
+}
+
+// 检查batch中的一项,复用getTopicChan的检查逻辑, MREGISTER还要检查保留名字
+func validateBatchItem(policy *protocol.NamePolicy, command string, item batchItem) error {
+	params := []string{item.Topic}
+	if item.Channel != "" {
+		params = append(params, item.Channel)
+	}
+	_, _, err := getTopicChan(policy, command, params)
+	if err != nil {
+		return err
+	}
+	if command != "MREGISTER" {
+		if item.TTL != "" {
+			return protocol.NewClientErr(nil, "E_INVALID", fmt.Sprintf("%s does not support ttl", command))
 		}
-		if left == 0 && strings.HasSuffix(topic, "#ephemeral") {
-			p.nsqlookupd.DB.RemoveRegistration(key)
+		return nil
+	}
+	err = checkNewTopicChan(policy, command, item.Topic, item.Channel)
+	if err != nil {
+		return err
+	}
+	if item.TTL != "" {
+		_, err = getTTLOption(command, map[string]string{"ttl": item.TTL})
+	}
+	return err
+}
+
+// nsqd定期上报每个topic的负载情况,body是json格式的 {"topics":[{"topic":"xx","depth":0,"in_flight":0,"message_rate":0}]}
+// 负载信息存在对应topic的Producer上,lookup的时候可以按负载排序
+func (p *LookupProtocolV1) STATS(client *ClientV1, reader *bufio.Reader, params []string) ([]byte, error) {
+	if client.peerInfo == nil {
+		return nil, protocol.NewFatalClientErr(nil, "E_INVALID", "client must IDENTIFY")
+	}
+	body, err := readBody("STATS", reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var report struct {
+		Topics []TopicStats `json:"topics"`
+	}
+	// body已经完整读出来了,json解析失败不影响后面的命令,所以不是致命错误
+	err = json.Unmarshal(body, &report)
+	if err != nil {
+		return nil, protocol.NewClientErr(err, "E_BAD_BODY", "STATS failed to decode JSON body")
+	}
+	for _, stats := range report.Topics {
+		if err := p.nsqlookupd.live().namePolicy.ValidateSyntax(stats.Topic); err != nil {
+			return nil, protocol.NewClientErr(err, "E_BAD_TOPIC", fmt.Sprintf("STATS topic name '%s' is not valid - %s", stats.Topic, err))
 		}
 	}
+
+	updated := p.nsqlookupd.DB.UpdateProducerStats(client.peerInfo.Namespace, client.peerInfo.id, report.Topics)
+	p.nsqlookupd.logf(LOG_DEBUG, "CLIENT(%s): STATS %d topics (%d updated)", client, len(report.Topics), updated)
 	return []byte("OK"), nil
 }
 
-// 从params中获取 topic 和 channel
+// 读取 4字节大端长度 + body 格式的数据
+// 读失败的话后面的数据就对不上了,所以都是致命错误
+func readBody(command string, reader *bufio.Reader) ([]byte, error) {
+	var bodyLen int32
+	err := binary.Read(reader, binary.BigEndian, &bodyLen)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", fmt.Sprintf("%s failed to read body size", command))
+	}
+	if bodyLen <= 0 {
+		return nil, protocol.NewFatalClientErr(nil, "E_BAD_BODY", fmt.Sprintf("%s invalid body size %d", command, bodyLen))
+	}
+	body := make([]byte, bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		return nil, protocol.NewFatalClientErr(err, "E_BAD_BODY", fmt.Sprintf("%s failed to read body", command))
+	}
+	return body, nil
+}
+
+// 从params中获取 topic 和 channel, 这里只检查名字的长度和字符
 // command参数都是写死的,只是为了日志中方便排查问题
-func getTopicChan(command string, params []string) (string, string, error) {
+func getTopicChan(policy *protocol.NamePolicy, command string, params []string) (string, string, error) {
 	if len(params) == 0 {
 		return "", "", protocol.NewFatalClientErr(nil, "E_INVALID", fmt.Sprintf("%s insufficient number of params", command))
 	}
@@ -254,11 +578,61 @@ func getTopicChan(command string, params []string) (string, string, error) {
 	if len(params) >= 2 {
 		channelName = params[1]
 	}
-	if !protocol.IsValidTopicName(topicName) {
-		return "", "", protocol.NewFatalClientErr(nil, "E_BAD_TOPIC", fmt.Sprintf("%s topic name '%s' is not valid", command, topicName))
+	if err := policy.ValidateSyntax(topicName); err != nil {
+		return "", "", protocol.NewFatalClientErr(err, "E_BAD_TOPIC", fmt.Sprintf("%s topic name '%s' is not valid - %s", command, topicName, err))
 	}
-	if channelName != "" && !protocol.IsValidChannelName(channelName) {
-		return "", "", protocol.NewFatalClientErr(nil, "E_BAD_CHANNEL", fmt.Sprintf("%s channel name '%s' is not valid", command, channelName))
+	if channelName != "" {
+		if err := policy.ValidateSyntax(channelName); err != nil {
+			return "", "", protocol.NewFatalClientErr(err, "E_BAD_CHANNEL", fmt.Sprintf("%s channel name '%s' is not valid - %s", command, channelName, err))
+		}
 	}
 	return topicName, channelName, nil
 }
+
+// 把 key=value 形式的参数分出来, 第一个参数一定是topic
+func splitOptions(params []string) ([]string, map[string]string) {
+	var args []string
+	options := make(map[string]string)
+	for i, param := range params {
+		if i > 0 && strings.Contains(param, "=") {
+			kv := strings.SplitN(param, "=", 2)
+			options[kv[0]] = kv[1]
+			continue
+		}
+		args = append(args, param)
+	}
+	return args, options
+}
+
+// 目前只支持ttl一个选项, 没有ttl返回0
+// 参数已经完整读出来了, 选项不对不影响后面的命令, 所以不是致命错误
+func getTTLOption(command string, options map[string]string) (time.Duration, error) {
+	for name := range options {
+		if name != "ttl" {
+			return 0, protocol.NewClientErr(nil, "E_INVALID", fmt.Sprintf("%s unknown option '%s'", command, name))
+		}
+	}
+	v, ok := options["ttl"]
+	if !ok {
+		return 0, nil
+	}
+	ttl, err := parseTTL(v)
+	if err != nil {
+		return 0, protocol.NewClientErr(err, "E_BAD_TTL", fmt.Sprintf("%s ttl '%s' is not valid - %s", command, v, err))
+	}
+	return ttl, nil
+}
+
+// 注册新的topic/channel的时候再检查保留名字和#ephemeral
+// 名字本身是合法的,只是这个nsqlookupd不允许, 断开连接的话nsqd别的topic也没了, 所以不是致命错误
+func checkNewTopicChan(policy *protocol.NamePolicy, command string, topicName string, channelName string) error {
+	if err := policy.ValidateTopicName(topicName); err != nil {
+		return protocol.NewClientErr(err, "E_BAD_TOPIC", fmt.Sprintf("%s topic name '%s' is not allowed - %s", command, topicName, err))
+	}
+	if channelName != "" {
+		if err := policy.ValidateChannelName(channelName); err != nil {
+			return protocol.NewClientErr(err, "E_BAD_CHANNEL", fmt.Sprintf("%s channel name '%s' is not allowed - %s", command, channelName, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package nsqlookupd
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"regexp"
+)
+
+// 多个团队共用一套nsqlookupd的时候, topic名字可能会重复
+// 每个namespace里面的topic/channel/nsqd是完全隔离的
+// nsqd在IDENTIFY的时候通过namespace字段选择, HTTP接口通过namespace参数或者X-NSQ-Namespace头选择
+// 什么都不指定的就是默认namespace "", 和以前的行为一样
+
+// HTTP接口用来指定namespace的header, query参数namespace优先
+const NamespaceHeader = "X-NSQ-Namespace"
+
+var validNamespaceRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// 空字符串是默认namespace, 是合法的
+func isValidNamespace(ns string) bool {
+	if ns == "" {
+		return true
+	}
+	return len(ns) <= 64 && validNamespaceRegex.MatchString(ns)
+}
+
+// NamespaceACL 某个namespace的访问控制, 每一类token为空表示这一类操作不限制
+// HTTP接口的token放在 Authorization: Bearer <token> 里面
+type NamespaceACL struct {
+	Namespace      string   `json:"namespace"`
+	ProducerTokens []string `json:"producer_tokens"` // nsqd IDENTIFY的时候namespace_token要是其中一个
+	ConsumerTokens []string `json:"consumer_tokens"` // HTTP查询接口
+	AdminTokens    []string `json:"admin_tokens"`    // HTTP管理接口, 也可以用来查询
+}
+
+// ACL检查的操作类型
+const (
+	aclProducer = "producer"
+	aclConsumer = "consumer"
+	aclAdmin    = "admin"
+)
+
+func validateNamespaceACLs(acls []NamespaceACL) (map[string]*NamespaceACL, error) {
+	results := make(map[string]*NamespaceACL)
+	for i := range acls {
+		acl := &acls[i]
+		if !isValidNamespace(acl.Namespace) {
+			return nil, fmt.Errorf("invalid namespace %q in ACL", acl.Namespace)
+		}
+		if _, ok := results[acl.Namespace]; ok {
+			return nil, fmt.Errorf("duplicate ACL for namespace %q", acl.Namespace)
+		}
+		results[acl.Namespace] = acl
+	}
+	return results, nil
+}
+
+// 检查token有没有权限在namespace里做role对应的操作, 没有配置ACL的namespace都允许
+func (l *NSQLookupd) checkNamespaceACL(namespace string, role string, token string) bool {
+	acl, ok := l.live().namespaceACLs[namespace]
+	if !ok {
+		return true
+	}
+	switch role {
+	case aclProducer:
+		return len(acl.ProducerTokens) == 0 || containsToken(acl.ProducerTokens, token)
+	case aclConsumer:
+		return len(acl.ConsumerTokens) == 0 ||
+			containsToken(acl.ConsumerTokens, token) || containsToken(acl.AdminTokens, token)
+	case aclAdmin:
+		return len(acl.AdminTokens) == 0 || containsToken(acl.AdminTokens, token)
+	}
+	return false
+}
+
+// 比较token用固定时间的比较, 不会因为比较的耗时泄露token
+func containsToken(tokens []string, token string) bool {
+	found := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return token != "" && found
+}
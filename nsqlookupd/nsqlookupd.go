@@ -2,13 +2,18 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"github.com/xswwhy/nsq/internal/http_api"
 	"github.com/xswwhy/nsq/internal/protocol"
+	"github.com/xswwhy/nsq/internal/proxyproto"
 	"github.com/xswwhy/nsq/internal/util"
 	"github.com/xswwhy/nsq/internal/version"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 type NSQLookupd struct {
@@ -17,8 +22,23 @@ type NSQLookupd struct {
 	tcpListener  net.Listener // 监听nsqd
 	httpListener net.Listener // 监听nsqadmin
 	tcpServer    *tcpServer
+	httpServer   *httpServer
 	watiGroup    util.WaitGroupWrapper
 	DB           *RegistrationDB // 所有的nsqd都在这里面注册
+	auditLog     *AuditLog       // DB的每次修改都记录一下,为nil表示不记录
+	webhook      *webhookNotifier
+	health       *healthChecker  // 没开健康检查的时候为nil
+	drainedNodes map[string]bool // 被drain的节点 broadcast_address:http_port, 用NSQLookupd的锁保护, 只在DB的事务里改
+
+	config       atomic.Value // *liveConfig, 可以热加载的配置, 用live()读
+	reloadLock   sync.Mutex   // 同一时间只有一个热加载
+	quotaMetrics quotaMetrics
+	reapExitChan chan struct{} // 通知reapLoop退出
+
+	httpSrv      *http.Server // 关闭的时候用来断开keep-alive的连接
+	phase        int32        // ShutdownPhase, 原子操作
+	shutdownOnce sync.Once
+	cmdGate      sync.RWMutex // TCP命令执行的时候持有读锁, 关闭的时候拿写锁等它们执行完
 }
 
 func New(opts *Options) (*NSQLookupd, error) {
@@ -27,16 +47,83 @@ func New(opts *Options) (*NSQLookupd, error) {
 		opts.Logger = log.New(os.Stderr, opts.LogPrefix, log.Ldate|log.Ltime|log.Lmicroseconds)
 	}
 	l := &NSQLookupd{
-		opts: opts,
-		DB:   NewRegistrationDB(),
+		opts:         opts,
+		DB:           NewRegistrationDB(),
+		drainedNodes: make(map[string]bool),
+		reapExitChan: make(chan struct{}),
+		httpSrv:      &http.Server{},
 	}
+	// logf要用live()里的日志等级, 所以最先设置
+	cfg, err := newLiveConfig(opts.ReloadableOptions)
+	if err != nil {
+		return nil, err
+	}
+	l.config.Store(cfg)
 	l.logf(LOG_INFO, version.String("nsqlookup"))
 
+	err = validateStaticProducers(opts.StaticProducers, cfg.namePolicy)
+	if err != nil {
+		return nil, err
+	}
+	l.loadStaticProducers()
+
+	if len(opts.WebhookURLs) > 0 {
+		l.webhook, err = newWebhookNotifier(l, opts)
+		if err != nil {
+			return nil, err
+		}
+		l.DB.SetListener(l.webhook.Notify)
+	}
+
+	if opts.RegistrationReapInterval <= 0 {
+		return nil, fmt.Errorf("invalid registration reap interval %s", opts.RegistrationReapInterval)
+	}
+
+	if opts.HealthCheckInterval > 0 {
+		l.health, err = newHealthChecker(l, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	socketMode, err := parseSocketMode(opts.UnixSocketMode)
+	if err != nil {
+		return nil, err
+	}
+	proxyTrusted, err := proxyproto.ParseCIDRs(opts.ProxyProtocolTrustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	// 配置都检查完了再打开文件和端口, 后面出错的时候要关掉前面打开的
+	if opts.AuditLogSize > 0 {
+		l.auditLog, err = NewAuditLog(opts.AuditLogSize, opts.AuditLogPath, opts.AuditLogMaxBytes, opts.AuditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	l.tcpServer = &tcpServer{nsqlookupd: l}
-	l.tcpListener, err = net.Listen("tcp", opts.TCPAddress)
+	l.tcpListener, err = listen(opts.TCPAddress, socketMode)
 	if err != nil {
+		if l.auditLog != nil {
+			l.auditLog.Close()
+		}
 		return nil, fmt.Errorf("listrn (%s) failed - %s", opts.TCPAddress, err)
 	}
+	l.httpListener, err = listen(opts.HTTPAddress, socketMode)
+	if err != nil {
+		l.tcpListener.Close()
+		if l.auditLog != nil {
+			l.auditLog.Close()
+		}
+		return nil, fmt.Errorf("listen (%s) failed - %s", opts.HTTPAddress, err)
+	}
+	// 真实的客户端地址会作为ClientV1的id, 也就是PeerInfo的id和RemoteAddress
+	if len(proxyTrusted) > 0 {
+		l.tcpListener = proxyproto.NewListener(l.tcpListener, proxyTrusted, opts.ProxyProtocolTimeout)
+		l.httpListener = proxyproto.NewListener(l.httpListener, proxyTrusted, opts.ProxyProtocolTimeout)
+	}
 
 	return l, nil
 }
@@ -55,28 +142,70 @@ func (l *NSQLookupd) Main() error {
 	l.watiGroup.Wrap(func() { // FIXME: 这里不是很明白为什么要用waitGroup包一下,直接go启动不行嘛?
 		exifFunc(protocol.TCPServer(l.tcpListener, l.tcpServer, l.logf))
 	})
+	l.httpServer = newHTTPServer(l)
+	l.httpSrv.Handler = l.httpServer
+	l.watiGroup.Wrap(func() {
+		exifFunc(http_api.ServeServer(l.httpSrv, l.httpListener, "HTTP", l.logf))
+	})
+	if l.webhook != nil {
+		l.watiGroup.Wrap(l.webhook.loop)
+	}
+	if l.health != nil {
+		l.watiGroup.Wrap(l.health.loop)
+	}
+	l.watiGroup.Wrap(l.reapLoop)
 
 	err := <-exitChain
 	return err
 }
 
+// RealTCPAddr 监听的是unix socket的时候返回nil, 用TCPListenAddr
 func (l *NSQLookupd) RealTCPAddr() *net.TCPAddr {
-	return l.tcpListener.Addr().(*net.TCPAddr)
+	addr, _ := l.tcpListener.Addr().(*net.TCPAddr)
+	return addr
 }
 
+// RealHTTPAddr 监听的是unix socket的时候返回nil, 用HTTPListenAddr
 func (l *NSQLookupd) RealHTTPAddr() *net.TCPAddr {
-	return l.httpListener.Addr().(*net.TCPAddr)
+	addr, _ := l.httpListener.Addr().(*net.TCPAddr)
+	return addr
 }
 
-func (l *NSQLookupd) Exit() {
-	if l.tcpListener != nil {
-		l.tcpListener.Close()
+// TCPListenAddr 实际监听的地址, 可能是*net.TCPAddr也可能是*net.UnixAddr
+func (l *NSQLookupd) TCPListenAddr() net.Addr {
+	return l.tcpListener.Addr()
+}
+
+// HTTPListenAddr 实际监听的地址, 可能是*net.TCPAddr也可能是*net.UnixAddr
+func (l *NSQLookupd) HTTPListenAddr() net.Addr {
+	return l.httpListener.Addr()
+}
+
+// 监听TCP或者unix socket, unix socket按配置修改文件权限, 控制哪些用户能连上来
+func listen(addr string, socketMode os.FileMode) (net.Listener, error) {
+	listener, err := util.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	if util.IsUnixAddress(addr) && socketMode != 0 {
+		_, path := util.ParseAddress(addr)
+		err = os.Chmod(path, socketMode)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
 	}
-	if l.tcpServer != nil {
-		l.tcpServer.Close()
+	return listener, nil
+}
+
+// 八进制的权限, 比如0660, 为空表示不修改
+func parseSocketMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
 	}
-	if l.httpListener != nil {
-		l.httpListener.Close()
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid unix socket mode %q", s)
 	}
-	l.watiGroup.Wait()
+	return os.FileMode(mode), nil
 }
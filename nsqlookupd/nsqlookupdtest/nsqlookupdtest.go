@@ -0,0 +1,322 @@
+// nsqlookupdtest 在进程内启动nsqlookupd,给集成测试用
+// TCP和HTTP都监听在127.0.0.1的随机端口上,日志用lg.NilLogger,不会刷屏
+package nsqlookupdtest
+
+import (
+	"fmt"
+	"github.com/xswwhy/nsq/internal/http_api"
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/internal/util"
+	"github.com/xswwhy/nsq/lookupclient"
+	"github.com/xswwhy/nsq/nsqlookupd"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 等待nsqlookupd可以提供服务的最长时间
+const readyTimeout = 5 * time.Second
+
+type Server struct {
+	*nsqlookupd.NSQLookupd
+	Opts *nsqlookupd.Options
+
+	mu        sync.Mutex
+	producers []*lookupclient.Client
+	nextPort  int // 没指定端口的FakeProducer用的序号
+	mainErr   chan error
+	closed    bool
+}
+
+// Start 启动一个nsqlookupd并等它准备好, configure可以修改默认的Options
+func Start(configure ...func(*nsqlookupd.Options)) (*Server, error) {
+	opts := nsqlookupd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.BroadcastAddress = "127.0.0.1"
+	opts.Logger = lg.NilLogger{}
+	for _, fn := range configure {
+		fn(opts)
+	}
+
+	l, err := nsqlookupd.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		NSQLookupd: l,
+		Opts:       opts,
+		mainErr:    make(chan error, 1),
+	}
+	go func() {
+		s.mainErr <- l.Main()
+	}()
+
+	err = s.waitReady()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// New 和Start一样,出错直接让测试失败,测试结束的时候自动Close
+func New(t testing.TB, configure ...func(*nsqlookupd.Options)) *Server {
+	t.Helper()
+	s, err := Start(configure...)
+	if err != nil {
+		t.Fatalf("failed to start nsqlookupd - %s", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// 一直请求 /ping 直到返回OK
+func (s *Server) waitReady() error {
+	client, base := http_api.NewClient(s.HTTPAddr(), 100*time.Millisecond)
+	url := base + "/ping"
+	deadline := time.Now().Add(readyTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-s.mainErr:
+			return fmt.Errorf("nsqlookupd exited before ready - %v", err)
+		default:
+		}
+		resp, err := client.Get(url)
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && string(body) == "OK" {
+				return nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("nsqlookupd not ready after %s", readyTimeout)
+}
+
+// 监听unix socket的时候返回 unix:///path, lookupclient可以直接用
+func (s *Server) TCPAddr() string {
+	return util.AddrString(s.TCPListenAddr())
+}
+
+func (s *Server) HTTPAddr() string {
+	return util.AddrString(s.HTTPListenAddr())
+}
+
+// Close 断开所有假的producer,然后关掉nsqlookupd, 可以调用多次
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	producers := s.producers
+	s.producers = nil
+	s.mu.Unlock()
+
+	for _, p := range producers {
+		p.Close()
+	}
+	s.Exit()
+}
+
+// FakeProducer 假的nsqd, 通过真正的TCP协议注册到nsqlookupd上
+type FakeProducer struct {
+	NodeID           string // 为空的话nsqlookupd用地址和端口生成
+	BroadcastAddress string
+	TCPPort          int // TCPPort和HTTPPort为0的话, 第n个这样的producer用4150+10n和4151+10n
+	HTTPPort         int
+	Version          string
+	Labels           map[string]string
+	Namespace        string
+	NamespaceToken   string
+
+	// 要注册的topic和channel, channel为空的表示只注册topic
+	Topics map[string][]string
+}
+
+// RegisterProducer 连上nsqlookupd,IDENTIFY之后注册所有的topic/channel
+// 返回的Client可以用来继续注册,或者Close()模拟nsqd断开
+func (s *Server) RegisterProducer(p FakeProducer) (*lookupclient.Client, error) {
+	if p.BroadcastAddress == "" {
+		p.BroadcastAddress = "127.0.0.1"
+	}
+	if p.Version == "" {
+		p.Version = "test"
+	}
+	// 端口也是node_id的一部分, 不然这些producer会被当成同一个nsqd互相顶掉
+	if p.TCPPort == 0 || p.HTTPPort == 0 {
+		s.mu.Lock()
+		offset := 10 * s.nextPort
+		s.nextPort++
+		s.mu.Unlock()
+		if p.TCPPort == 0 {
+			p.TCPPort = 4150 + offset
+		}
+		if p.HTTPPort == 0 {
+			p.HTTPPort = 4151 + offset
+		}
+	}
+	c := lookupclient.New(s.TCPAddr(), lookupclient.Config{
+		NodeID:           p.NodeID,
+		BroadcastAddress: p.BroadcastAddress,
+		Hostname:         p.BroadcastAddress,
+		TCPPort:          p.TCPPort,
+		HTTPPort:         p.HTTPPort,
+		Version:          p.Version,
+		Labels:           p.Labels,
+		Namespace:        p.Namespace,
+		NamespaceToken:   p.NamespaceToken,
+	})
+	_, err := c.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]string, 0, len(p.Topics))
+	for t := range p.Topics {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	for _, t := range topics {
+		if len(p.Topics[t]) == 0 {
+			err = c.Register(t, "")
+		}
+		for _, ch := range p.Topics[t] {
+			if err == nil {
+				err = c.Register(t, ch)
+			}
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	s.producers = append(s.producers, c)
+	s.mu.Unlock()
+	return c, nil
+}
+
+// MustRegisterProducer 和RegisterProducer一样,出错直接让测试失败
+func (s *Server) MustRegisterProducer(t testing.TB, p FakeProducer) *lookupclient.Client {
+	t.Helper()
+	c, err := s.RegisterProducer(p)
+	if err != nil {
+		t.Fatalf("failed to register producer %s:%d - %s", p.BroadcastAddress, p.TCPPort, err)
+	}
+	return c
+}
+
+// Topics 默认namespace的所有topic, 排好序的
+// 下面的查询和检查都是针对默认namespace的, 其他namespace用InNamespace
+func (s *Server) Topics() []string {
+	return s.InNamespace("").Topics()
+}
+
+// Channels topic下所有的channel, 排好序的
+func (s *Server) Channels(topic string) []string {
+	return s.InNamespace("").Channels(topic)
+}
+
+// Producers topic下所有producer的 broadcast_address:tcp_port, 排好序的
+func (s *Server) Producers(topic string) []string {
+	return s.InNamespace("").Producers(topic)
+}
+
+// AssertTopics 检查当前的topic正好是want(顺序无所谓)
+func (s *Server) AssertTopics(t testing.TB, want ...string) {
+	t.Helper()
+	s.InNamespace("").AssertTopics(t, want...)
+}
+
+// AssertChannels 检查topic下的channel正好是want(顺序无所谓)
+func (s *Server) AssertChannels(t testing.TB, topic string, want ...string) {
+	t.Helper()
+	s.InNamespace("").AssertChannels(t, topic, want...)
+}
+
+// AssertProducers 检查topic的producer正好是want, 格式是 broadcast_address:tcp_port
+func (s *Server) AssertProducers(t testing.TB, topic string, want ...string) {
+	t.Helper()
+	s.InNamespace("").AssertProducers(t, topic, want...)
+}
+
+// Namespace 某个namespace里的查询和检查
+type Namespace struct {
+	s  *Server
+	ns string
+}
+
+func (s *Server) InNamespace(ns string) *Namespace {
+	return &Namespace{s: s, ns: ns}
+}
+
+func (n *Namespace) Topics() []string {
+	topics := n.s.DB.FindRegistrations(n.ns, "topic", "*", "").Keys()
+	sort.Strings(topics)
+	return topics
+}
+
+func (n *Namespace) Channels(topic string) []string {
+	channels := n.s.DB.FindRegistrations(n.ns, "channel", topic, "*").SubKeys()
+	sort.Strings(channels)
+	return channels
+}
+
+func (n *Namespace) Producers(topic string) []string {
+	var producers []string
+	for _, p := range n.s.DB.FindProducers(n.ns, "topic", topic, "", nil).PeerInfo() {
+		producers = append(producers, fmt.Sprintf("%s:%d", p.BroadcastAddress, p.TCPPort))
+	}
+	sort.Strings(producers)
+	return producers
+}
+
+func (n *Namespace) AssertTopics(t testing.TB, want ...string) {
+	t.Helper()
+	assertStrings(t, fmt.Sprintf("topics of namespace(%s)", n.ns), n.Topics(), want)
+}
+
+func (n *Namespace) AssertChannels(t testing.TB, topic string, want ...string) {
+	t.Helper()
+	assertStrings(t, fmt.Sprintf("channels of topic(%s) in namespace(%s)", topic, n.ns), n.Channels(topic), want)
+}
+
+func (n *Namespace) AssertProducers(t testing.TB, topic string, want ...string) {
+	t.Helper()
+	assertStrings(t, fmt.Sprintf("producers of topic(%s) in namespace(%s)", topic, n.ns), n.Producers(topic), want)
+}
+
+// Eventually 在timeout之内反复检查cond,一直不满足就让测试失败
+// nsqd断开之后nsqlookupd清理是异步的,这种情况要用Eventually
+func Eventually(t testing.TB, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met after %s: %s", timeout, msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func assertStrings(t testing.TB, what string, got []string, want []string) {
+	t.Helper()
+	want = append([]string{}, want...)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %v, want %v", what, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: got %v, want %v", what, got, want)
+		}
+	}
+}
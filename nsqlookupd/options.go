@@ -1,14 +1,138 @@
 package nsqlookupd
 
-import "github.com/xswwhy/nsq/internal/lg"
+import (
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/internal/protocol"
+	"log"
+	"os"
+	"time"
+)
 
 type Options struct {
 	// 日志相关
-	LogLever  lg.LogLevel
-	LogPrefix string
+	LogPrefix string `flag:"log-prefix"`
 	Logger    Logger
 
-	// 服务相关
-	TCPAddress       string
+	// 服务相关, TCPAddress HTTPAddress 可以写成 unix:///path/to.sock 监听unix socket
+	// UnixSocketMode 是socket文件的权限(八进制, 比如0660), 为空表示不修改
+	TCPAddress       string `flag:"tcp-address"`
+	HTTPAddress      string `flag:"http-address"`
 	BroadcastAddress string `flag:"broadcast-address"`
+	UnixSocketMode   string `flag:"unix-socket-mode"`
+
+	// 在HAProxy之类的四层负载均衡后面的时候, 从ProxyProtocolTrustedCIDRs来的TCP和HTTP连接必须先发PROXY protocol v1/v2头
+	// 头里的客户端地址作为连接的RemoteAddr, 为空表示不解析PROXY头
+	ProxyProtocolTrustedCIDRs []string      `flag:"proxy-protocol-trusted-cidr"`
+	ProxyProtocolTimeout      time.Duration `flag:"proxy-protocol-timeout"`
+
+	// 审计日志, 内存里保留最近AuditLogSize条, 配置了AuditLogPath的话也会写到文件里
+	AuditLogSize       int    `flag:"audit-log-size"`
+	AuditLogPath       string `flag:"audit-log-path"`
+	AuditLogMaxBytes   int64  `flag:"audit-log-max-bytes"`
+	AuditLogMaxBackups int    `flag:"audit-log-max-backups"`
+
+	// DB有变化的时候POST json事件到这些url, WebhookEvents为空表示所有类型的事件都发
+	WebhookURLs       []string      `flag:"webhook-url"`
+	WebhookEvents     []string      `flag:"webhook-event"`
+	WebhookQueueSize  int           `flag:"webhook-queue-size"` // 每个url一个队列
+	WebhookMaxRetries int           `flag:"webhook-max-retries"`
+	WebhookTimeout    time.Duration `flag:"webhook-timeout"`
+	WebhookBackoff    time.Duration `flag:"webhook-backoff"`
+
+	// 定时请求每个nsqd的/ping, 连续失败HealthCheckFailureThreshold次之后lookup不再返回它
+	// HealthCheckInterval为0表示不检查
+	// 请求的地址是客户端IDENTIFY的时候自己填的, 谁能连上来就能让nsqlookupd去GET任意地址, 只在客户端都可信的时候打开
+	HealthCheckInterval         time.Duration `flag:"health-check-interval"`
+	HealthCheckTimeout          time.Duration `flag:"health-check-timeout"`
+	HealthCheckFailureThreshold int           `flag:"health-check-failure-threshold"`
+
+	// 多久检查一次没有producer超过TTL的Registration, #ephemeral的也是这时候清理
+	RegistrationReapInterval time.Duration `flag:"registration-reap-interval"`
+
+	// 收到SIGINT SIGTERM之后最多等ShutdownTimeout, 超时了就直接断开所有连接
+	// ShutdownDrainDelay 是/ping返回DRAINING之后等多久再关掉HTTP, 留时间给负载均衡摘掉这个实例
+	// ShutdownStatePath 不为空的话关闭之前把DB导出到这个文件, 可以用lookupctl import导入
+	ShutdownTimeout    time.Duration `flag:"shutdown-timeout"`
+	ShutdownDrainDelay time.Duration `flag:"shutdown-drain-delay"`
+	ShutdownStatePath  string        `flag:"shutdown-state-path"`
+
+	// 配置里写死的nsqd, 启动的时候注册到DB里, 没有对应的命令行参数,只能在配置文件里配置
+	StaticProducers []StaticProducer `flag:"static-producers"`
+
+	// 热加载的时候用来重新读配置, 命令行参数和配置文件的合并规则和启动的时候一样, 为nil表示不支持热加载
+	ConfigLoader func() (*Options, error)
+
+	// 上面的配置修改之后要重启才能生效, 下面的可以热加载
+	ReloadableOptions
+}
+
+// ReloadableOptions 收到SIGHUP或者POST /config/reload的时候重新加载, 不用重启
+type ReloadableOptions struct {
+	LogLever lg.LogLevel `flag:"log-level"`
+
+	// nsqd超过InactiveProducerTimeout没有PING,查找的时候就不再返回它
+	InactiveProducerTimeout time.Duration `flag:"inactive-producer-timeout"`
+	// tombstone之后,TombstoneLifetime时间内查找的时候不返回该producer
+	TombstoneLifetime time.Duration `flag:"tombstone-lifetime"`
+
+	// topic/channel注册数量的限制, 超过了REGISTER返回E_QUOTA_EXCEEDED, 0表示不限制
+	MaxRegistrationsPerProducer  int `flag:"max-registrations-per-producer"`
+	MaxChannelsPerTopic          int `flag:"max-channels-per-topic"`
+	MaxRegistrations             int `flag:"max-registrations"`
+	MaxRegistrationsPerNamespace int `flag:"max-registrations-per-namespace"`
+
+	// topic/channel的命名规则, NamePattern匹配的是去掉#ephemeral后缀的名字
+	// 保留的名字和前缀只在注册新的topic/channel的时候检查, 查询和删除不受影响
+	NameMaxLength        int      `flag:"name-max-length"`
+	NamePattern          string   `flag:"name-pattern"`
+	ReservedNames        []string `flag:"reserved-name"`
+	ReservedNamePrefixes []string `flag:"reserved-name-prefix"`
+	AllowEphemeralNames  bool     `flag:"allow-ephemeral-names"`
+
+	// 每个namespace的访问控制, 没有配置的namespace不限制, 只能在配置文件里配置
+	NamespaceACLs []NamespaceACL `flag:"namespace-acls"`
+}
+
+// 默认配置
+func NewOptions() *Options {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &Options{
+		LogPrefix: "[nsqlookupd] ",
+
+		TCPAddress:       "0.0.0.0:4160",
+		HTTPAddress:      "0.0.0.0:4161",
+		BroadcastAddress: hostname,
+
+		ProxyProtocolTimeout: 5 * time.Second,
+
+		AuditLogSize:       10000,
+		AuditLogMaxBytes:   100 * 1024 * 1024,
+		AuditLogMaxBackups: 5,
+
+		WebhookQueueSize:  1000,
+		WebhookMaxRetries: 3,
+		WebhookTimeout:    5 * time.Second,
+		WebhookBackoff:    time.Second,
+
+		HealthCheckTimeout:          2 * time.Second,
+		HealthCheckFailureThreshold: 3,
+
+		RegistrationReapInterval: time.Second,
+
+		ShutdownTimeout: 10 * time.Second,
+
+		ReloadableOptions: ReloadableOptions{
+			LogLever: lg.INFO,
+
+			InactiveProducerTimeout: 300 * time.Second,
+			TombstoneLifetime:       45 * time.Second,
+
+			NameMaxLength:       protocol.DefaultNameMaxLength,
+			NamePattern:         protocol.DefaultNamePattern,
+			AllowEphemeralNames: true,
+		},
+	}
 }
@@ -0,0 +1,249 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 配额的类型
+const (
+	QuotaProducer         = "producer"           // 一个nsqd最多注册多少个topic/channel
+	QuotaChannelsPerTopic = "channels_per_topic" // 一个topic下最多多少个channel
+	QuotaTotal            = "total"              // 整个DB最多多少个topic/channel
+	QuotaNamespace        = "namespace"          // 一个namespace里最多多少个topic/channel
+)
+
+// Quotas Registration数量的限制, 0表示不限制
+// 只统计topic和channel, "client"不算
+type Quotas struct {
+	MaxPerProducer      int
+	MaxChannelsPerTopic int
+	MaxTotal            int
+	MaxPerNamespace     int
+}
+
+// QuotaError 超过了哪个配额
+type QuotaError struct {
+	Kind  string
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded (max %d)", e.Kind, e.Limit)
+}
+
+// RegistrationDB里的计数, 调用方要持有写锁
+type registrationCounts struct {
+	total      int
+	namespaces map[string]int       // namespace -> topic/channel数
+	channels   map[Registration]int // topic的Registration -> channel数
+	producers  map[string]int       // peerInfo.id -> 注册了多少个topic/channel
+}
+
+func newRegistrationCounts() registrationCounts {
+	return registrationCounts{
+		namespaces: make(map[string]int),
+		channels:   make(map[Registration]int),
+		producers:  make(map[string]int),
+	}
+}
+
+// channel所属的topic的Registration
+func topicOf(k Registration) Registration {
+	return Registration{k.Namespace, "topic", k.Key, ""}
+}
+
+func (c *registrationCounts) addRegistration(k Registration) {
+	if k.Category == "client" {
+		return
+	}
+	c.total++
+	c.namespaces[k.Namespace]++
+	if k.Category == "channel" {
+		c.channels[topicOf(k)]++
+	}
+}
+
+func (c *registrationCounts) removeRegistration(k Registration) {
+	if k.Category == "client" {
+		return
+	}
+	c.total--
+	decr(c.namespaces, k.Namespace)
+	if k.Category == "channel" {
+		t := topicOf(k)
+		if c.channels[t]--; c.channels[t] <= 0 {
+			delete(c.channels, t)
+		}
+	}
+}
+
+func (c *registrationCounts) addProducer(k Registration, id string) {
+	if k.Category != "client" {
+		c.producers[id]++
+	}
+}
+
+func (c *registrationCounts) removeProducer(k Registration, id string) {
+	if k.Category != "client" {
+		decr(c.producers, id)
+	}
+}
+
+func decr(m map[string]int, key string) {
+	if m[key]--; m[key] <= 0 {
+		delete(m, key)
+	}
+}
+
+// CheckQuota 检查id注册keys之后会不会超过配额, id为空表示不是nsqd注册的(管理接口创建的)
+// 只检查, 不修改; 检查通过之后在同一个事务里注册才不会被别人插队
+func (tx *RegistrationTx) CheckQuota(q Quotas, keys []Registration, id string) *QuotaError {
+	db := tx.db
+	newTotal := 0
+	newProducer := 0
+	newNamespaces := make(map[string]int)
+	newChannels := make(map[Registration]int)
+	for _, k := range keys {
+		if k.Category == "client" {
+			continue
+		}
+		producers, exists := db.registrationMap[k]
+		if !exists {
+			newTotal++
+			newNamespaces[k.Namespace]++
+			if k.Category == "channel" {
+				newChannels[topicOf(k)]++
+			}
+		}
+		if id != "" {
+			if _, ok := producers[id]; !ok {
+				newProducer++
+			}
+		}
+	}
+
+	if q.MaxPerProducer > 0 && newProducer > 0 && db.counts.producers[id]+newProducer > q.MaxPerProducer {
+		return &QuotaError{QuotaProducer, q.MaxPerProducer}
+	}
+	if q.MaxChannelsPerTopic > 0 {
+		for t, n := range newChannels {
+			if db.counts.channels[t]+n > q.MaxChannelsPerTopic {
+				return &QuotaError{QuotaChannelsPerTopic, q.MaxChannelsPerTopic}
+			}
+		}
+	}
+	if q.MaxTotal > 0 && newTotal > 0 && db.counts.total+newTotal > q.MaxTotal {
+		return &QuotaError{QuotaTotal, q.MaxTotal}
+	}
+	if q.MaxPerNamespace > 0 {
+		for ns, n := range newNamespaces {
+			if db.counts.namespaces[ns]+n > q.MaxPerNamespace {
+				return &QuotaError{QuotaNamespace, q.MaxPerNamespace}
+			}
+		}
+	}
+	return nil
+}
+
+// RegistrationStats DB当前的大小
+type RegistrationStats struct {
+	Total      int            `json:"total"`
+	Namespaces map[string]int `json:"namespaces"`
+	Producers  int            `json:"producers"` // 注册了topic/channel的nsqd数
+}
+
+func (r *RegistrationDB) Stats() RegistrationStats {
+	r.RLock()
+	defer r.RUnlock()
+	namespaces := make(map[string]int, len(r.counts.namespaces))
+	for ns, n := range r.counts.namespaces {
+		namespaces[ns] = n
+	}
+	return RegistrationStats{
+		Total:      r.counts.total,
+		Namespaces: namespaces,
+		Producers:  len(r.counts.producers),
+	}
+}
+
+// 每种配额被拒绝的次数
+type quotaMetrics struct {
+	producer         int64
+	channelsPerTopic int64
+	total            int64
+	namespace        int64
+}
+
+func (m *quotaMetrics) incr(kind string) {
+	switch kind {
+	case QuotaProducer:
+		atomic.AddInt64(&m.producer, 1)
+	case QuotaChannelsPerTopic:
+		atomic.AddInt64(&m.channelsPerTopic, 1)
+	case QuotaTotal:
+		atomic.AddInt64(&m.total, 1)
+	case QuotaNamespace:
+		atomic.AddInt64(&m.namespace, 1)
+	}
+}
+
+func (m *quotaMetrics) snapshot() map[string]int64 {
+	return map[string]int64{
+		QuotaProducer:         atomic.LoadInt64(&m.producer),
+		QuotaChannelsPerTopic: atomic.LoadInt64(&m.channelsPerTopic),
+		QuotaTotal:            atomic.LoadInt64(&m.total),
+		QuotaNamespace:        atomic.LoadInt64(&m.namespace),
+	}
+}
+
+func (l *NSQLookupd) quotas() Quotas {
+	cfg := l.live()
+	return Quotas{
+		MaxPerProducer:      cfg.MaxRegistrationsPerProducer,
+		MaxChannelsPerTopic: cfg.MaxChannelsPerTopic,
+		MaxTotal:            cfg.MaxRegistrations,
+		MaxPerNamespace:     cfg.MaxRegistrationsPerNamespace,
+	}
+}
+
+// 在一个事务里检查配额并注册, 超过配额的时候什么都不注册, 记一下metrics
+// peerInfo为nil表示管理接口创建的, 只有Registration没有producer
+// ttl大于0的时候设置在keys[0]上, 也在同一个事务里, 不然别的操作可能看到还没有TTL的Registration
+// 返回值和keys一一对应, 表示是不是新注册的
+func (l *NSQLookupd) addWithQuota(keys []Registration, peerInfo *PeerInfo, ttl time.Duration) ([]bool, *QuotaError) {
+	added := make([]bool, len(keys))
+	var qerr *QuotaError
+	l.DB.Update(func(tx *RegistrationTx) {
+		qerr = l.checkQuota(tx, keys, peerInfo)
+		if qerr != nil {
+			return
+		}
+		for i, k := range keys {
+			if peerInfo == nil {
+				_, exists := tx.db.registrationMap[k]
+				tx.AddRegistration(k)
+				added[i] = !exists
+				continue
+			}
+			added[i] = tx.AddProducer(k, &Producer{peerInfo: peerInfo})
+		}
+		if ttl > 0 {
+			tx.SetTTL(keys[0], ttl)
+		}
+	})
+	return added, qerr
+}
+
+func (l *NSQLookupd) checkQuota(tx *RegistrationTx, keys []Registration, peerInfo *PeerInfo) *QuotaError {
+	id := ""
+	if peerInfo != nil {
+		id = peerInfo.id
+	}
+	qerr := tx.CheckQuota(l.quotas(), keys, id)
+	if qerr != nil {
+		l.quotaMetrics.incr(qerr.Kind)
+	}
+	return qerr
+}
@@ -2,6 +2,8 @@ package nsqlookupd
 
 import (
 	"fmt"
+	"io"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,34 +14,55 @@ import (
 type RegistrationDB struct {
 	sync.RWMutex
 	registrationMap map[Registration]ProducerMap
+	listener        func(RegistrationEvent)     // DB有变化的时候通知出去,是在持有写锁的时候调用的,不能阻塞
+	counts          registrationCounts          // 检查配额用的计数,和registrationMap一起修改
+	lifecycles      map[Registration]*lifecycle // 设置了TTL或者带#ephemeral的Registration
 }
 
 // RegistrationDB 的 key
+// Namespace 为空是默认namespace, 不同namespace里同名的topic是不相干的
 type Registration struct {
-	Category string
-	Key      string
-	SubKey   string
+	Namespace string
+	Category  string
+	Key       string
+	SubKey    string
 }
 
-func (k Registration) IsMatch(category string, key string, subkey string) bool {
+// namespace key subkey 都支持*通配符
+func (k Registration) IsMatch(namespace string, category string, key string, subkey string) bool {
+	if namespace != "*" && namespace != k.Namespace {
+		return false
+	}
 	if category != k.Category {
 		return false
 	}
 	if key != "*" && key != k.Key {
 		return false
 	}
-	if subkey != "*" && key != k.Key {
+	if subkey != "*" && subkey != k.SubKey {
 		return false
 	}
 	return true
 }
 
+// topic或者channel的名字带#ephemeral后缀,没有producer的时候Registration也要删掉
+func (k Registration) IsEphemeral() bool {
+	switch k.Category {
+	case "topic":
+		return strings.HasSuffix(k.Key, "#ephemeral")
+	case "channel":
+		return strings.HasSuffix(k.SubKey, "#ephemeral")
+	}
+	return false
+}
+
 type Registrations []Registration
 
+// 不区分namespace
 func (rr Registrations) Filter(category string, key string, subkey string) Registrations {
 	output := Registrations{}
 	for _, k := range rr {
-		if k.IsMatch(category, key, subkey) {
+		if k.IsMatch("*", category, key, subkey) {
 			output = append(output, k)
 		}
 	}
@@ -64,19 +87,30 @@ func (rr Registrations) SubKeys() []string {
 
 type PeerInfo struct {
 	lastUpdate       int64
-	id               string // ip+端口 作为id  // FIXME:RemoteAddress也是ip+端口,和id是一样的,多个id字段可能是为了当id作为key值的时候更好理解吧
-	RemoteAddress    string `json:"remote_address"`
-	Hostname         string `json:"hostname"`
-	BroadcastAddress string `json:"broadcast_address"`
-	TCPPort          int    `json:"tcp_port"`
-	HTTPPort         int    `json:"http_port"`
-	Version          string `json:"version"`
+	id               string    // namespace/node_id, 重连之后不变, 见identity.go
+	static           bool      // 配置里写死的producer, 没有TCP连接,也不会PING
+	unhealthy        int32     // 健康检查连续失败,原子操作
+	draining         int32     // 节点在维护,查找的时候不返回,原子操作
+	replaced         int32     // 被同一个id的新连接替换了,原子操作
+	conn             io.Closer // 被替换的时候用来断开旧连接, 静态的和导入的producer没有
+	NodeID           string    `json:"node_id,omitempty"`
+	RemoteAddress    string    `json:"remote_address"` // TCP连接的地址
+	Hostname         string    `json:"hostname"`
+	BroadcastAddress string    `json:"broadcast_address"`
+	TCPPort          int       `json:"tcp_port"`
+	HTTPPort         int       `json:"http_port"`
+	Version          string    `json:"version"`
+	Namespace        string    `json:"namespace,omitempty"` // nsqd IDENTIFY的时候选择的namespace, 它的所有Registration都在这个namespace里
+
+	// nsqd自己打的标签,比如 env=prod tier=batch,consumer可以用Selector按标签筛选
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type Producer struct {
+	tombstoneAt int64 // UnixNano, 0表示没有tombstone; 读Producer的时候不持有DB的锁, 要用atomic
 	peerInfo    *PeerInfo
-	tombstoned  bool
-	tombstoneAt time.Time
+	stats       atomic.Value // *TopicStats, 只有topic的Producer才会有
+	inheritedAt time.Time    // 从被替换掉的连接接管过来或者导入的时间, 连着的nsqd重新REGISTER之后是零值
 }
 
 func (p *Producer) String() string {
@@ -84,12 +118,21 @@ func (p *Producer) String() string {
 }
 
 func (p *Producer) Tombstone() {
-	p.tombstoned = true
-	p.tombstoneAt = time.Now()
+	atomic.StoreInt64(&p.tombstoneAt, time.Now().UnixNano())
+}
+
+// 没有tombstone的时候返回false
+func (p *Producer) TombstonedAt() (time.Time, bool) {
+	at := atomic.LoadInt64(&p.tombstoneAt)
+	if at == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, at), true
 }
 
 func (p *Producer) IsTombstoned(lifetime time.Duration) bool {
-	return p.tombstoned && time.Now().Sub(p.tombstoneAt) < lifetime
+	at, tombstoned := p.TombstonedAt()
+	return tombstoned && time.Now().Sub(at) < lifetime
 }
 
 type Producers []*Producer
@@ -100,7 +143,8 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	for _, p := range pp {
 		cur := time.Unix(0, atomic.LoadInt64(&p.peerInfo.lastUpdate))
 		// 失去心跳超过inactivityTimeout || 死亡时间 < tombstoneLifetime
-		if now.Sub(cur) > inactivityTimeout || p.IsTombstoned(tombstoneLifetime) {
+		// 静态producer不会PING, 不检查心跳, 但是tombstone还是有效的
+		if (!p.peerInfo.static && now.Sub(cur) > inactivityTimeout) || p.IsTombstoned(tombstoneLifetime) {
 			continue
 		}
 		results = append(results, p)
@@ -108,6 +152,34 @@ func (pp Producers) FilterByActive(inactivityTimeout time.Duration, tombstoneLif
 	return results
 }
 
+// 按label筛选, selector为空时原样返回
+func (pp Producers) FilterBySelector(selector Selector) Producers {
+	if len(selector) == 0 {
+		return pp
+	}
+	results := Producers{}
+	for _, p := range pp {
+		if selector.Matches(p.peerInfo.Labels) {
+			results = append(results, p)
+		}
+	}
+	return results
+}
+
+// 去掉drain了的节点, category是"client"的时候原样返回
+func (pp Producers) filterDraining(category string) Producers {
+	if category == "client" {
+		return pp
+	}
+	results := Producers{}
+	for _, p := range pp {
+		if !p.peerInfo.IsDraining() {
+			results = append(results, p)
+		}
+	}
+	return results
+}
+
 func (pp Producers) PeerInfo() []*PeerInfo {
 	results := []*PeerInfo{}
 	for _, p := range pp {
@@ -122,29 +194,63 @@ type ProducerMap map[string]*Producer
 func NewRegistrationDB() *RegistrationDB {
 	return &RegistrationDB{
 		registrationMap: make(map[Registration]ProducerMap),
+		counts:          newRegistrationCounts(),
+		lifecycles:      make(map[Registration]*lifecycle),
 	}
 }
 
 func (r *RegistrationDB) AddRegistration(k Registration) {
 	r.Lock()
 	defer r.Unlock()
+	r.addRegistration(k)
+}
+
+// 调用方要持有写锁
+func (r *RegistrationDB) addRegistration(k Registration) {
 	_, ok := r.registrationMap[k]
 	if !ok {
 		r.registrationMap[k] = make(map[string]*Producer)
+		r.counts.addRegistration(k)
+		r.initLifecycle(k)
+		r.notify(EventRegistrationAdd, k, nil)
 	}
 }
 
 func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 	r.Lock()
 	defer r.Unlock()
-	_, ok := r.registrationMap[k]
-	if !ok {
-		r.registrationMap[k] = make(map[string]*Producer)
+	return r.addProducer(k, p)
+}
+
+// 一次加锁注册多个Registration,每个Registration都会新建一个Producer
+// 返回值和keys一一对应,表示是不是新注册的
+func (r *RegistrationDB) AddProducers(keys []Registration, peerInfo *PeerInfo) []bool {
+	added := make([]bool, len(keys))
+	r.Update(func(tx *RegistrationTx) {
+		for i, k := range keys {
+			added[i] = tx.AddProducer(k, &Producer{peerInfo: peerInfo})
+		}
+	})
+	return added
+}
+
+// 调用方要持有写锁
+// 被替换掉的旧连接还在处理的命令不能再注册
+func (r *RegistrationDB) addProducer(k Registration, p *Producer) bool {
+	if p.peerInfo.isReplaced() {
+		return false
 	}
+	r.addRegistration(k)
 	produces := r.registrationMap[k]
-	_, fount := produces[p.peerInfo.id]
+	existing, fount := produces[p.peerInfo.id]
 	if !fount {
 		produces[p.peerInfo.id] = p
+		r.counts.addProducer(k, p.peerInfo.id)
+		r.touchLifecycle(k)
+		r.notify(EventProducerAdd, k, p.peerInfo)
+	} else if !existing.inheritedAt.IsZero() {
+		// 接管过来的Registration重新REGISTER了, reaper不会再删它
+		produces[p.peerInfo.id] = existing.clone(existing.peerInfo)
 	}
 	return !fount
 }
@@ -152,36 +258,79 @@ func (r *RegistrationDB) AddProducer(k Registration, p *Producer) bool {
 func (r *RegistrationDB) RemoveProducer(k Registration, id string) (bool, int) {
 	r.Lock()
 	defer r.Unlock()
+	return r.removeProducer(k, id)
+}
+
+// 一次加锁从多个Registration中删除该producer
+// 返回值和keys一一对应,表示是不是真的删掉了
+// 带#ephemeral的Registration在最后一个producer删掉之后,Registration也一起删, 见ReleaseProducer
+func (r *RegistrationDB) RemoveProducers(keys []Registration, id string) []bool {
+	removed := make([]bool, len(keys))
+	r.Update(func(tx *RegistrationTx) {
+		for i, k := range keys {
+			removed[i], _ = tx.ReleaseProducer(k, id)
+		}
+	})
+	return removed
+}
+
+// 调用方要持有写锁
+func (r *RegistrationDB) removeProducer(k Registration, id string) (bool, int) {
 	producers, ok := r.registrationMap[k]
 	if !ok {
 		return false, 0
 	}
 	removed := false
-	if _, exists := producers[id]; exists {
+	if p, exists := producers[id]; exists {
 		removed = true
+		delete(producers, id)
+		r.counts.removeProducer(k, id)
+		r.touchLifecycle(k)
+		r.notify(EventProducerRemove, k, p.peerInfo)
+		if len(producers) == 0 && k.Category == "topic" {
+			r.notify(EventTopicEmpty, k, p.peerInfo)
+		}
 	}
-	delete(producers, id)
 	return removed, len(producers)
 }
 
 func (r *RegistrationDB) RemoveRegistration(k Registration) {
 	r.Lock()
 	defer r.Unlock()
-	delete(r.registrationMap, k)
+	r.removeRegistration(k)
+}
+
+// 调用方要持有写锁
+func (r *RegistrationDB) removeRegistration(k Registration) {
+	if producers, ok := r.registrationMap[k]; ok {
+		// Registration上还有producer的话(比如管理接口删topic), producer的计数也要减掉
+		for id := range producers {
+			r.counts.removeProducer(k, id)
+		}
+		delete(r.registrationMap, k)
+		delete(r.lifecycles, k)
+		r.counts.removeRegistration(k)
+		r.notify(EventRegistrationRemove, k, nil)
+	}
 }
 
 // RegistrationDB 支持精确查找,还支持*通配符实现模糊查找
-func (r *RegistrationDB) needFilter(key string, subkey string) bool {
-	return key == "*" || subkey == "*"
+func (r *RegistrationDB) needFilter(namespace string, key string, subkey string) bool {
+	return namespace == "*" || key == "*" || subkey == "*"
 }
 
 // 根据key 找Registrations
-func (r *RegistrationDB) FindRegistrations(category string, key string, subkey string) Registrations {
+func (r *RegistrationDB) FindRegistrations(namespace string, category string, key string, subkey string) Registrations {
 	r.RLock()
-	r.RUnlock()
+	defer r.RUnlock()
+	return r.findRegistrations(namespace, category, key, subkey)
+}
+
+// 调用方要持有读锁或者写锁
+func (r *RegistrationDB) findRegistrations(namespace string, category string, key string, subkey string) Registrations {
 	// 精确查找, Registrations中只可能有一个Registration
-	if !r.needFilter(key, subkey) {
-		k := Registration{category, key, subkey}
+	if !r.needFilter(namespace, key, subkey) {
+		k := Registration{namespace, category, key, subkey}
 		if _, ok := r.registrationMap[k]; ok {
 			return Registrations{k}
 		}
@@ -190,7 +339,7 @@ func (r *RegistrationDB) FindRegistrations(category string, key string, subkey s
 	// 模糊查找, Registrations中可能有多个Registration
 	result := Registrations{}
 	for k := range r.registrationMap {
-		if !k.IsMatch(category, key, subkey) {
+		if !k.IsMatch(namespace, category, key, subkey) {
 			continue
 		}
 		result = append(result, k)
@@ -198,23 +347,30 @@ func (r *RegistrationDB) FindRegistrations(category string, key string, subkey s
 	return result
 }
 
-// 根据key 找Producers
-func (r *RegistrationDB) FindProducers(category string, key string, subkey string) Producers {
+// 根据key 找Producers, selector不为空的时候只返回label匹配的Producer
+// drain了的节点不返回, "client"除外, 不然/nodes里就看不到它了
+func (r *RegistrationDB) FindProducers(namespace string, category string, key string, subkey string, selector Selector) Producers {
 	r.RLock()
 	defer r.RUnlock()
 	// 精确查找
-	if !r.needFilter(key, subkey) {
-		k := Registration{category, key, subkey}
-		return ProducerMap2Slice(r.registrationMap[k])
+	if !r.needFilter(namespace, key, subkey) {
+		k := Registration{namespace, category, key, subkey}
+		return ProducerMap2Slice(r.registrationMap[k]).FilterBySelector(selector).filterDraining(category)
 	}
 	// 模糊查找
 	results := make(map[string]struct{}) // 这个results是去重用的,value采用空结构体可以省内存
 	var retProducers Producers
 	for k, producers := range r.registrationMap {
-		if !k.IsMatch(category, key, subkey) {
+		if !k.IsMatch(namespace, category, key, subkey) {
 			continue
 		}
 		for _, producer := range producers {
+			if !selector.Matches(producer.peerInfo.Labels) {
+				continue
+			}
+			if category != "client" && producer.peerInfo.IsDraining() {
+				continue
+			}
 			_, fount := results[producer.peerInfo.id]
 			if fount == false {
 				results[producer.peerInfo.id] = struct{}{}
@@ -228,7 +384,12 @@ func (r *RegistrationDB) FindProducers(category string, key string, subkey strin
 // 根据 producer.peerInfo.id 找Registrations
 func (r *RegistrationDB) LookupRegistrations(id string) Registrations {
 	r.RLock()
-	defer r.Unlock()
+	defer r.RUnlock()
+	return r.lookupRegistrations(id)
+}
+
+// 调用方要持有读锁或者写锁
+func (r *RegistrationDB) lookupRegistrations(id string) Registrations {
 	results := Registrations{}
 	for k, producers := range r.registrationMap {
 		if _, exists := producers[id]; exists {
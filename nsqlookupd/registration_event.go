@@ -0,0 +1,48 @@
+package nsqlookupd
+
+import "time"
+
+// RegistrationDB 变化的事件类型
+const (
+	EventRegistrationAdd    = "registration_add"    // 新建了Registration(topic或者channel出现了)
+	EventRegistrationRemove = "registration_remove" // 删除了Registration
+	EventProducerAdd        = "producer_add"        // 某个nsqd注册到了Registration上
+	EventProducerRemove     = "producer_remove"     // 某个nsqd从Registration上删掉了
+	EventTopicEmpty         = "topic_empty"         // topic的最后一个producer没了
+)
+
+// RegistrationEvent RegistrationDB的一次变化
+// Producer 只有producer相关的事件才有
+type RegistrationEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace,omitempty"`
+	Category  string    `json:"category"`
+	Key       string    `json:"key"`
+	SubKey    string    `json:"subkey"`
+	Producer  *PeerInfo `json:"producer,omitempty"`
+}
+
+// SetListener 设置DB变化的回调,fn是在持有DB写锁的时候调用的
+// 所以fn必须很快返回,不能阻塞,也不能再调用RegistrationDB的方法
+func (r *RegistrationDB) SetListener(fn func(RegistrationEvent)) {
+	r.Lock()
+	defer r.Unlock()
+	r.listener = fn
+}
+
+// 调用方要持有写锁
+func (r *RegistrationDB) notify(eventType string, k Registration, peerInfo *PeerInfo) {
+	if r.listener == nil {
+		return
+	}
+	r.listener(RegistrationEvent{
+		Type:      eventType,
+		Time:      time.Now(),
+		Namespace: k.Namespace,
+		Category:  k.Category,
+		Key:       k.Key,
+		SubKey:    k.SubKey,
+		Producer:  peerInfo,
+	})
+}
@@ -0,0 +1,41 @@
+package nsqlookupd
+
+// RegistrationTx 是Update()期间RegistrationDB的视图
+// RegistrationDB的每个方法都是单独加锁的,连续调用几次的中间别人可能会看到只改了一半的状态
+// 比如nsqd断开的时候要从很多个Registration中删除它,放到一个Update()里面就是原子的了
+// 注意: RegistrationTx 只能在Update()的回调里面用,不能保存下来
+type RegistrationTx struct {
+	db *RegistrationDB
+}
+
+// Update 持有写锁执行fn, fn里面对DB的所有修改对其他人来说是一次性生效的
+// fn里面不能再调用RegistrationDB的方法,否则会死锁
+func (r *RegistrationDB) Update(fn func(tx *RegistrationTx)) {
+	r.Lock()
+	defer r.Unlock()
+	fn(&RegistrationTx{db: r})
+}
+
+func (tx *RegistrationTx) AddRegistration(k Registration) {
+	tx.db.addRegistration(k)
+}
+
+func (tx *RegistrationTx) AddProducer(k Registration, p *Producer) bool {
+	return tx.db.addProducer(k, p)
+}
+
+func (tx *RegistrationTx) RemoveProducer(k Registration, id string) (bool, int) {
+	return tx.db.removeProducer(k, id)
+}
+
+func (tx *RegistrationTx) RemoveRegistration(k Registration) {
+	tx.db.removeRegistration(k)
+}
+
+func (tx *RegistrationTx) FindRegistrations(namespace string, category string, key string, subkey string) Registrations {
+	return tx.db.findRegistrations(namespace, category, key, subkey)
+}
+
+func (tx *RegistrationTx) LookupRegistrations(id string) Registrations {
+	return tx.db.lookupRegistrations(id)
+}
@@ -0,0 +1,190 @@
+package nsqlookupd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/lg"
+	"github.com/xswwhy/nsq/internal/protocol"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 热加载: 收到SIGHUP或者POST /config/reload的时候重新读配置
+// 只有ReloadableOptions里的配置能热加载, 别的配置变了的话整个配置都不生效, 要重启
+// 新的配置先全部检查一遍, 再一次性替换掉正在用的, 不会有只改了一半的时候
+
+var ErrReloadDisabled = errors.New("config reload is disabled")
+
+// 正在用的可以热加载的配置, 和从它生成的东西, 热加载的时候整个替换
+type liveConfig struct {
+	ReloadableOptions
+	namePolicy    *protocol.NamePolicy
+	namespaceACLs map[string]*NamespaceACL // 没有配置ACL的namespace不在里面
+}
+
+func newLiveConfig(opts ReloadableOptions) (*liveConfig, error) {
+	if opts.LogLever < lg.DEBUG || opts.LogLever > lg.FATAL {
+		return nil, fmt.Errorf("invalid log level %d", opts.LogLever)
+	}
+	if opts.InactiveProducerTimeout <= 0 {
+		return nil, fmt.Errorf("invalid inactive producer timeout %s", opts.InactiveProducerTimeout)
+	}
+	if opts.TombstoneLifetime < 0 {
+		return nil, fmt.Errorf("invalid tombstone lifetime %s", opts.TombstoneLifetime)
+	}
+	if opts.MaxRegistrationsPerProducer < 0 || opts.MaxChannelsPerTopic < 0 ||
+		opts.MaxRegistrations < 0 || opts.MaxRegistrationsPerNamespace < 0 {
+		return nil, fmt.Errorf("registration quotas must not be negative")
+	}
+	acls, err := validateNamespaceACLs(opts.NamespaceACLs)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := protocol.NewNamePolicy(opts.NameMaxLength, opts.NamePattern,
+		opts.ReservedNames, opts.ReservedNamePrefixes, opts.AllowEphemeralNames)
+	if err != nil {
+		return nil, err
+	}
+	return &liveConfig{
+		ReloadableOptions: opts,
+		namePolicy:        policy,
+		namespaceACLs:     acls,
+	}, nil
+}
+
+func (l *NSQLookupd) live() *liveConfig {
+	return l.config.Load().(*liveConfig)
+}
+
+// ConfigChange 一个配置项的变化, Option是配置文件里的名字
+type ConfigChange struct {
+	Option     string `json:"option"`
+	Old        string `json:"old"`
+	New        string `json:"new"`
+	Reloadable bool   `json:"reloadable"`
+}
+
+// ReloadReport 热加载的结果, 没有生效的话Errors里是原因
+type ReloadReport struct {
+	Applied bool           `json:"applied"`
+	Changes []ConfigChange `json:"changes"`
+	Errors  []string       `json:"errors,omitempty"`
+}
+
+func (r *ReloadReport) String() string {
+	var parts []string
+	for _, c := range r.Changes {
+		s := fmt.Sprintf("%s: %s -> %s", c.Option, c.Old, c.New)
+		if !c.Reloadable {
+			s += " (requires restart)"
+		}
+		parts = append(parts, s)
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "no changes")
+	}
+	parts = append(parts, r.Errors...)
+	return strings.Join(parts, "; ")
+}
+
+// ReloadConfig 用Options.ConfigLoader重新读配置, 然后Reload
+func (l *NSQLookupd) ReloadConfig() (*ReloadReport, error) {
+	if l.opts.ConfigLoader == nil {
+		l.logf(LOG_WARN, "CONFIG: %s", ErrReloadDisabled)
+		return nil, ErrReloadDisabled
+	}
+	opts, err := l.opts.ConfigLoader()
+	if err != nil {
+		l.logf(LOG_ERROR, "CONFIG: failed to load config - %s", err)
+		return nil, err
+	}
+	return l.Reload(opts)
+}
+
+// Reload 用opts里可以热加载的配置替换正在用的配置
+// 不能热加载的配置变了或者新配置不合法的话什么都不改, 返回的error不为nil, report里有diff和原因
+func (l *NSQLookupd) Reload(opts *Options) (*ReloadReport, error) {
+	l.reloadLock.Lock()
+	defer l.reloadLock.Unlock()
+
+	current := *l.opts
+	current.ReloadableOptions = l.live().ReloadableOptions
+	report := &ReloadReport{Changes: diffOptions(&current, opts)}
+	for _, c := range report.Changes {
+		if !c.Reloadable {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s cannot be changed without a restart", c.Option))
+		}
+	}
+	cfg, err := newLiveConfig(opts.ReloadableOptions)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if len(report.Errors) > 0 {
+		l.logf(LOG_ERROR, "CONFIG: reload rejected - %s", report)
+		return report, fmt.Errorf("config rejected - %s", strings.Join(report.Errors, "; "))
+	}
+
+	l.config.Store(cfg)
+	report.Applied = true
+	l.logf(LOG_WARN, "CONFIG: reloaded - %s", report)
+	return report, nil
+}
+
+// 按flag tag一项一项比较, ConfigLoader Logger这种没有flag tag的不比较
+func diffOptions(old *Options, new *Options) []ConfigChange {
+	changes := []ConfigChange{}
+	var walk func(o reflect.Value, n reflect.Value, reloadable bool)
+	walk = func(o reflect.Value, n reflect.Value, reloadable bool) {
+		typ := o.Type()
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Anonymous && field.Type == reflect.TypeOf(ReloadableOptions{}) {
+				walk(o.Field(i), n.Field(i), true)
+				continue
+			}
+			name := field.Tag.Get("flag")
+			if name == "" || reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+				continue
+			}
+			// 配置文件里写了[]和没写是一样的
+			if o.Field(i).Kind() == reflect.Slice && o.Field(i).Len() == 0 && n.Field(i).Len() == 0 {
+				continue
+			}
+			changes = append(changes, ConfigChange{
+				Option:     strings.Replace(name, "-", "_", -1),
+				Old:        formatOption(o.Field(i).Interface()),
+				New:        formatOption(n.Field(i).Interface()),
+				Reloadable: reloadable,
+			})
+		}
+	}
+	walk(reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), false)
+	return changes
+}
+
+// 和配置文件里的写法一样, ACL里的token不能出现在日志和接口的返回里
+func formatOption(v interface{}) string {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case lg.LogLevel:
+		// String()返回的是WARNING, 配置文件里写的是warn
+		if v == lg.WARN {
+			return "warn"
+		}
+		return strings.ToLower(v.String())
+	case []NamespaceACL:
+		namespaces := make([]string, len(v))
+		for i, acl := range v {
+			namespaces[i] = fmt.Sprintf("%q", acl.Namespace)
+		}
+		return "namespaces [" + strings.Join(namespaces, " ") + "] (tokens hidden)"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
@@ -0,0 +1,127 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// label的key和value都要遵守命名规则,和k8s的label差不多
+var validLabelRegex = regexp.MustCompile(`^[a-zA-Z0-9_./-]+$`)
+
+func isValidLabel(s string) bool {
+	if len(s) > 64 || len(s) < 1 {
+		return false
+	}
+	return validLabelRegex.MatchString(s)
+}
+
+// 检查nsqd IDENTIFY 时带过来的labels
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !isValidLabel(k) {
+			return fmt.Errorf("invalid label key '%s'", k)
+		}
+		if v != "" && !isValidLabel(v) {
+			return fmt.Errorf("invalid label value '%s' for key '%s'", v, k)
+		}
+	}
+	return nil
+}
+
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorExists    = "exists"
+	selectorNotExists = "!exists"
+)
+
+// selector中的一个条件,比如 env=prod  tier!=batch  gpu  !gpu
+type selectorTerm struct {
+	key   string
+	op    string
+	value string
+}
+
+func (t selectorTerm) matches(labels map[string]string) bool {
+	v, ok := labels[t.key]
+	switch t.op {
+	case selectorEquals:
+		return ok && v == t.value
+	case selectorNotEquals:
+		// 没有这个label也算不等于
+		return !ok || v != t.value
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return !ok
+	}
+	return false
+}
+
+func (t selectorTerm) String() string {
+	switch t.op {
+	case selectorExists:
+		return t.key
+	case selectorNotExists:
+		return "!" + t.key
+	}
+	return t.key + t.op + t.value
+}
+
+// Selector 用来按label筛选Producer,多个条件之间是"与"的关系
+// 空的Selector匹配所有Producer
+type Selector []selectorTerm
+
+// 解析 env=prod,tier!=batch 这种格式的selector
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return selector, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var term selectorTerm
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			term = selectorTerm{strings.TrimSpace(kv[0]), selectorNotEquals, strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			term = selectorTerm{strings.TrimSpace(kv[0]), selectorEquals, strings.TrimSpace(kv[1])}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			term = selectorTerm{strings.TrimSpace(kv[0]), selectorEquals, strings.TrimSpace(kv[1])}
+		case strings.HasPrefix(part, "!"):
+			term = selectorTerm{strings.TrimSpace(part[1:]), selectorNotExists, ""}
+		default:
+			term = selectorTerm{part, selectorExists, ""}
+		}
+		if !isValidLabel(term.key) {
+			return nil, fmt.Errorf("invalid selector term '%s'", part)
+		}
+		if (term.op == selectorEquals || term.op == selectorNotEquals) && term.value != "" && !isValidLabel(term.value) {
+			return nil, fmt.Errorf("invalid selector term '%s'", part)
+		}
+		selector = append(selector, term)
+	}
+	return selector, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, t := range s {
+		if !t.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	terms := make([]string, len(s))
+	for i, t := range s {
+		terms[i] = t.String()
+	}
+	return strings.Join(terms, ",")
+}
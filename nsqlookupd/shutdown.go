@@ -0,0 +1,178 @@
+package nsqlookupd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ShutdownPhase 关闭的阶段, Shutdown()按顺序经过每一个阶段
+type ShutdownPhase int32
+
+const (
+	PhaseRunning       ShutdownPhase = iota
+	PhaseStopAccepting               // 关掉TCP的listener, 不再接受新的nsqd连接; HTTP还在服务, 负载均衡要能看到/ping的变化
+	PhaseDraining                    // /ping返回503 DRAINING, 等ShutdownDrainDelay让负载均衡摘掉这个实例
+	PhaseFinishing                   // 等正在执行的TCP命令和HTTP请求完成, 之后的命令都不再执行
+	PhasePersisting                  // 配置了ShutdownStatePath的话把DB导出到文件
+	PhaseClosing                     // 断开所有连接, 停掉后台的goroutine
+	PhaseStopped
+)
+
+var phaseNames = []string{"running", "stop_accepting", "draining", "finishing", "persisting", "closing", "stopped"}
+
+func (p ShutdownPhase) String() string {
+	if int(p) < len(phaseNames) {
+		return phaseNames[p]
+	}
+	return "unknown"
+}
+
+func (l *NSQLookupd) ShutdownPhase() ShutdownPhase {
+	return ShutdownPhase(atomic.LoadInt32(&l.phase))
+}
+
+func (l *NSQLookupd) setPhase(phase ShutdownPhase) {
+	atomic.StoreInt32(&l.phase, int32(phase))
+	l.logf(LOG_INFO, "SHUTDOWN: %s", phase)
+}
+
+// 每个TCP命令执行之前调用, 返回false表示在关闭了, 不能再执行
+// 关闭的时候拿cmdGate的写锁, 就能等到正在执行的命令都执行完
+func (l *NSQLookupd) enterCommand() bool {
+	l.cmdGate.RLock()
+	if l.ShutdownPhase() >= PhaseFinishing {
+		l.cmdGate.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (l *NSQLookupd) leaveCommand() {
+	l.cmdGate.RUnlock()
+}
+
+// Shutdown 优雅关闭, ctx到期之后不再等待, 直接断开所有连接
+// 只有第一次调用生效, 后面的调用会等第一次完成, 返回nil
+func (l *NSQLookupd) Shutdown(ctx context.Context) error {
+	var err error
+	l.shutdownOnce.Do(func() {
+		err = l.shutdown(ctx, true)
+	})
+	return err
+}
+
+// Exit 马上关闭, 不等正在执行的命令和请求
+func (l *NSQLookupd) Exit() {
+	l.shutdownOnce.Do(func() {
+		l.shutdown(context.Background(), false)
+	})
+}
+
+// graceful为false的时候跳过等待负载均衡和等待正在执行的命令, 直接断开
+func (l *NSQLookupd) shutdown(ctx context.Context, graceful bool) error {
+	var err error
+
+	l.setPhase(PhaseStopAccepting)
+	if l.tcpListener != nil {
+		l.tcpListener.Close()
+	}
+
+	l.setPhase(PhaseDraining)
+	if graceful && l.opts.ShutdownDrainDelay > 0 {
+		t := time.NewTimer(l.opts.ShutdownDrainDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+
+	l.setPhase(PhaseFinishing)
+	gateLocked := make(chan struct{})
+	go func() {
+		l.cmdGate.Lock()
+		close(gateLocked)
+	}()
+	if graceful {
+		httpDone := make(chan struct{})
+		go func() {
+			// 关掉HTTP的listener和空闲的keep-alive连接, 等正在处理的请求完成
+			l.httpSrv.Shutdown(ctx)
+			close(httpDone)
+		}()
+		for _, done := range []chan struct{}{gateLocked, httpDone} {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if err != nil {
+				l.logf(LOG_WARN, "SHUTDOWN: gave up waiting for in-flight commands - %s", err)
+				break
+			}
+		}
+	}
+
+	// 这时候nsqd的连接还没断开, 导出的是关闭之前完整的状态
+	if l.opts.ShutdownStatePath != "" {
+		l.setPhase(PhasePersisting)
+		perr := l.persistState(l.opts.ShutdownStatePath)
+		if perr != nil {
+			l.logf(LOG_ERROR, "SHUTDOWN: failed to persist state to %s - %s", l.opts.ShutdownStatePath, perr)
+			if err == nil {
+				err = perr
+			}
+		}
+	}
+
+	l.setPhase(PhaseClosing)
+	l.httpSrv.Close() // 超时了还没完成的请求和keep-alive连接也断开
+	if l.httpListener != nil {
+		l.httpListener.Close()
+	}
+	if l.tcpServer != nil {
+		l.tcpServer.Close()
+	}
+	// 连接都断开了, 卡在读body的命令也会马上返回
+	<-gateLocked
+	l.cmdGate.Unlock()
+	if l.webhook != nil {
+		l.webhook.Close()
+	}
+	if l.health != nil {
+		l.health.Close()
+	}
+	close(l.reapExitChan)
+	l.watiGroup.Wait()
+	if l.auditLog != nil {
+		l.auditLog.Close()
+	}
+	l.setPhase(PhaseStopped)
+	return err
+}
+
+// 和GET /debug/registrations的格式一样, 可以用 lookupctl import 导入到新的nsqlookupd
+// 先写临时文件再rename, 不会留下写了一半的文件
+func (l *NSQLookupd) persistState(path string) error {
+	dump := l.DB.Export()
+	data, err := json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	l.logf(LOG_INFO, "SHUTDOWN: persisted %d registrations to %s", len(dump.Registrations), path)
+	return nil
+}
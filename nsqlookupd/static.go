@@ -0,0 +1,115 @@
+package nsqlookupd
+
+import (
+	"fmt"
+	"github.com/xswwhy/nsq/internal/protocol"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StaticProducer 在配置里写死的nsqd
+// 有些老的nsqd连不上nsqlookupd的TCP端口,但是它们的topic还是要能被查到
+type StaticProducer struct {
+	Hostname         string            `json:"hostname"`
+	BroadcastAddress string            `json:"broadcast_address"`
+	TCPPort          int               `json:"tcp_port"`
+	HTTPPort         int               `json:"http_port"`
+	Version          string            `json:"version"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Namespace        string            `json:"namespace,omitempty"`
+
+	// topic -> channel列表, 没有channel的topic写空列表
+	Topics map[string][]string `json:"topics"`
+}
+
+// 静态producer的id, 不会和TCP连接的id(ip:port)重复
+// 同一个nsqd可以在多个namespace里各配置一次
+func (sp StaticProducer) id() string {
+	addr := net.JoinHostPort(sp.BroadcastAddress, strconv.Itoa(sp.TCPPort))
+	if sp.Namespace != "" {
+		return "static:" + sp.Namespace + "/" + addr
+	}
+	return "static:" + addr
+}
+
+func (sp StaticProducer) validate(policy *protocol.NamePolicy) error {
+	if sp.BroadcastAddress == "" || sp.TCPPort == 0 || sp.HTTPPort == 0 {
+		return fmt.Errorf("broadcast_address, tcp_port and http_port are required")
+	}
+	if err := validateLabels(sp.Labels); err != nil {
+		return err
+	}
+	if !isValidNamespace(sp.Namespace) {
+		return fmt.Errorf("invalid namespace %q", sp.Namespace)
+	}
+	for topic, channels := range sp.Topics {
+		if err := policy.ValidateTopicName(topic); err != nil {
+			return fmt.Errorf("invalid topic name %q - %s", topic, err)
+		}
+		// 静态producer不会断开,#ephemeral没有意义
+		if strings.HasSuffix(topic, protocol.EphemeralSuffix) {
+			return fmt.Errorf("ephemeral topic %q not allowed", topic)
+		}
+		for _, channel := range channels {
+			if err := policy.ValidateChannelName(channel); err != nil {
+				return fmt.Errorf("invalid channel name %q in topic %q - %s", channel, topic, err)
+			}
+			if strings.HasSuffix(channel, protocol.EphemeralSuffix) {
+				return fmt.Errorf("ephemeral channel %q not allowed", channel)
+			}
+		}
+	}
+	return nil
+}
+
+func validateStaticProducers(producers []StaticProducer, policy *protocol.NamePolicy) error {
+	ids := make(map[string]bool)
+	for i, sp := range producers {
+		if err := sp.validate(policy); err != nil {
+			return fmt.Errorf("invalid static producer #%d - %s", i, err)
+		}
+		if ids[sp.id()] {
+			return fmt.Errorf("duplicate static producer %s:%d in namespace %q", sp.BroadcastAddress, sp.TCPPort, sp.Namespace)
+		}
+		ids[sp.id()] = true
+	}
+	return nil
+}
+
+// 启动的时候把静态producer注册到DB里
+// 它们没有TCP连接, 所以不会因为断开被删掉, 查找的时候也不检查心跳
+func (l *NSQLookupd) loadStaticProducers() {
+	for _, sp := range l.opts.StaticProducers {
+		peerInfo := &PeerInfo{
+			lastUpdate:       time.Now().UnixNano(),
+			id:               sp.id(),
+			static:           true,
+			RemoteAddress:    "static",
+			Hostname:         sp.Hostname,
+			BroadcastAddress: sp.BroadcastAddress,
+			TCPPort:          sp.TCPPort,
+			HTTPPort:         sp.HTTPPort,
+			Version:          sp.Version,
+			Labels:           sp.Labels,
+			Namespace:        sp.Namespace,
+		}
+		ns := sp.Namespace
+		keys := []Registration{{ns, "client", "", ""}}
+		topics := make([]string, 0, len(sp.Topics))
+		for topic := range sp.Topics {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			keys = append(keys, Registration{ns, "topic", topic, ""})
+			for _, channel := range sp.Topics[topic] {
+				keys = append(keys, Registration{ns, "channel", topic, channel})
+			}
+		}
+		l.DB.AddProducers(keys, peerInfo)
+		l.logf(LOG_INFO, "DB: static producer %s:%d registered %d topics", sp.BroadcastAddress, sp.TCPPort, len(topics))
+	}
+}
@@ -0,0 +1,121 @@
+package nsqlookupd
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TopicStats nsqd通过STATS命令上报的某个topic的负载情况
+type TopicStats struct {
+	Topic       string  `json:"topic"`
+	Depth       int64   `json:"depth"`
+	InFlight    int64   `json:"in_flight"`
+	MessageRate float64 `json:"message_rate"`
+	UpdatedAt   int64   `json:"updated_at"` // nsqlookupd收到STATS的时间,UnixNano
+}
+
+// 负载,积压的消息 + 正在处理的消息
+func (s *TopicStats) Load() int64 {
+	return s.Depth + s.InFlight
+}
+
+func (p *Producer) SetStats(stats *TopicStats) {
+	p.stats.Store(stats)
+}
+
+// 没上报过STATS的Producer返回nil
+func (p *Producer) Stats() *TopicStats {
+	stats, _ := p.stats.Load().(*TopicStats)
+	return stats
+}
+
+// 把STATS存到对应topic下该nsqd的Producer上,返回更新了几个topic
+// 没有REGISTER过的topic直接忽略
+func (r *RegistrationDB) UpdateProducerStats(namespace string, id string, stats []TopicStats) int {
+	// 只改Producer上的atomic.Value,不改map,读锁就够了
+	r.RLock()
+	defer r.RUnlock()
+	now := time.Now().UnixNano()
+	updated := 0
+	for i := range stats {
+		s := stats[i]
+		s.UpdatedAt = now
+		producers, ok := r.registrationMap[Registration{namespace, "topic", s.Topic, ""}]
+		if !ok {
+			continue
+		}
+		if producer, ok := producers[id]; ok {
+			producer.SetStats(&s)
+			updated++
+		}
+	}
+	return updated
+}
+
+// 按负载从低到高排序,没有上报STATS或者超过staleAfter没有更新的当成不知道, 排在最后
+// 负载一样的时候,消息速率低的排前面
+func (pp Producers) OrderByLoad(staleAfter time.Duration) Producers {
+	type producerLoad struct {
+		p     *Producer
+		stats *TopicStats
+	}
+	// 排序之前先把STATS取出来, 排序的时候STATS被更新了也不会乱
+	now := time.Now().UnixNano()
+	loads := make([]producerLoad, len(pp))
+	for i, p := range pp {
+		stats := p.Stats()
+		if stats != nil && now-stats.UpdatedAt > int64(staleAfter) {
+			stats = nil
+		}
+		loads[i] = producerLoad{p, stats}
+	}
+	sort.SliceStable(loads, func(i, j int) bool {
+		si, sj := loads[i].stats, loads[j].stats
+		if si == nil || sj == nil {
+			return si != nil && sj == nil
+		}
+		if si.Load() != sj.Load() {
+			return si.Load() < sj.Load()
+		}
+		return si.MessageRate < sj.MessageRate
+	})
+	results := make(Producers, len(loads))
+	for i, l := range loads {
+		results[i] = l.p
+	}
+	return results
+}
+
+// rand.Rand不能并发使用
+var (
+	shuffleLock sync.Mutex
+	shuffleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// 随机打乱顺序, consumer按返回的顺序连接的时候不会都挤到同一个nsqd上
+func (pp Producers) Shuffle() Producers {
+	results := make(Producers, len(pp))
+	copy(results, pp)
+	shuffleLock.Lock()
+	shuffleRand.Shuffle(len(results), func(i, j int) {
+		results[i], results[j] = results[j], results[i]
+	})
+	shuffleLock.Unlock()
+	return results
+}
+
+// lookup返回的producer, include_stats=true 的时候会带上负载信息
+type producerWithStats struct {
+	*PeerInfo
+	Stats *TopicStats `json:"stats,omitempty"`
+}
+
+func (pp Producers) peerInfoWithStats() []*producerWithStats {
+	results := []*producerWithStats{}
+	for _, p := range pp {
+		results = append(results, &producerWithStats{PeerInfo: p.peerInfo, Stats: p.Stats()})
+	}
+	return results
+}
@@ -39,7 +39,8 @@ func (p *tcpServer) Handle(conn net.Conn) {
 		return
 	}
 	client := prot.NewClient(conn)
-	p.conns.Store(conn.RemoteAddr(), client)
+	// 用conn本身作为key, unix socket的连接RemoteAddr都是一样的
+	p.conns.Store(conn, client)
 	// IOLoop 处理TCP连接的read write
 	err = prot.IOLoop(client)
 	if err != nil {
@@ -47,7 +48,7 @@ func (p *tcpServer) Handle(conn net.Conn) {
 		// 是因为nsqd是长期运行的,一旦连上nsqlookupd就不会轻易断开,除非出现了错误
 		p.nsqlookupd.logf(LOG_ERROR, "client(%s) - %s", conn.RemoteAddr(), err)
 	}
-	p.conns.Delete(conn.RemoteAddr())
+	p.conns.Delete(conn)
 	client.Close()
 }
 
@@ -0,0 +1,156 @@
+package nsqlookupd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/xswwhy/nsq/internal/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// 重试的时候等待时间翻倍,但是最多等这么久
+const maxWebhookBackoff = 60 * time.Second
+
+// webhookNotifier 把RegistrationDB的变化以json的形式POST到配置的url
+// DB的回调是在持有写锁的时候调用的,所以这里只是把事件放进队列,队列满了直接丢掉
+// 每个url有自己的队列和发送的goroutine, 一个url很慢或者连不上不会耽误别的url
+// 同一个url的事件按顺序发送,失败了会按backoff重试
+type webhookNotifier struct {
+	nsqlookupd *NSQLookupd
+	targets    []*webhookTarget
+	events     map[string]bool // 只发送这些类型的事件,为空表示全部都发
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+	exitChan   chan struct{}
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan RegistrationEvent
+}
+
+func newWebhookNotifier(l *NSQLookupd, opts *Options) (*webhookNotifier, error) {
+	if opts.WebhookQueueSize < 1 {
+		return nil, fmt.Errorf("invalid webhook queue size %d", opts.WebhookQueueSize)
+	}
+	if opts.WebhookMaxRetries < 0 {
+		return nil, fmt.Errorf("invalid webhook max retries %d", opts.WebhookMaxRetries)
+	}
+	if opts.WebhookBackoff <= 0 {
+		return nil, fmt.Errorf("invalid webhook backoff %s", opts.WebhookBackoff)
+	}
+	w := &webhookNotifier{
+		nsqlookupd: l,
+		events:     make(map[string]bool),
+		client:     &http.Client{Timeout: opts.WebhookTimeout},
+		maxRetries: opts.WebhookMaxRetries,
+		backoff:    opts.WebhookBackoff,
+		exitChan:   make(chan struct{}),
+	}
+	for _, url := range opts.WebhookURLs {
+		w.targets = append(w.targets, &webhookTarget{
+			url:   url,
+			queue: make(chan RegistrationEvent, opts.WebhookQueueSize),
+		})
+	}
+	for _, e := range opts.WebhookEvents {
+		switch e {
+		case EventRegistrationAdd, EventRegistrationRemove, EventProducerAdd, EventProducerRemove, EventTopicEmpty:
+			w.events[e] = true
+		default:
+			return nil, fmt.Errorf("invalid webhook event type '%s'", e)
+		}
+	}
+	return w, nil
+}
+
+// 作为RegistrationDB的listener, 不能阻塞
+func (w *webhookNotifier) Notify(e RegistrationEvent) {
+	if len(w.events) > 0 && !w.events[e.Type] {
+		return
+	}
+	for _, t := range w.targets {
+		select {
+		case t.queue <- e:
+		default:
+			w.nsqlookupd.logf(LOG_WARN, "WEBHOOK: queue for %s is full, dropping event %s %s:%s:%s",
+				t.url, e.Type, e.Category, e.Key, e.SubKey)
+		}
+	}
+}
+
+// 每个url启动一个发送循环, 全部退出之后返回
+func (w *webhookNotifier) loop() {
+	var wg util.WaitGroupWrapper
+	for _, t := range w.targets {
+		t := t
+		wg.Wrap(func() { w.targetLoop(t) })
+	}
+	wg.Wait()
+	w.nsqlookupd.logf(LOG_INFO, "WEBHOOK: closing")
+}
+
+// exitChan关闭之后退出, 队列里没发完的事件直接丢掉
+func (w *webhookNotifier) targetLoop(t *webhookTarget) {
+	for {
+		select {
+		case e := <-t.queue:
+			body, err := json.Marshal(e)
+			if err != nil {
+				w.nsqlookupd.logf(LOG_ERROR, "WEBHOOK: failed to marshal event - %s", err)
+				continue
+			}
+			w.deliver(t.url, body)
+		case <-w.exitChan:
+			return
+		}
+	}
+}
+
+// 发送一个事件,失败了重试maxRetries次
+func (w *webhookNotifier) deliver(url string, body []byte) {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.maxRetries {
+			w.nsqlookupd.logf(LOG_ERROR, "WEBHOOK: giving up on %s after %d attempts - %s", url, attempt+1, err)
+			return
+		}
+		w.nsqlookupd.logf(LOG_WARN, "WEBHOOK: POST %s failed (attempt %d) - %s, retrying in %s",
+			url, attempt+1, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-w.exitChan:
+			return
+		}
+		backoff *= 2
+		if backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+}
+
+func (w *webhookNotifier) post(url string, body []byte) error {
+	resp, err := w.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// body要读完,不然连接没法复用
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("got response %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhookNotifier) Close() {
+	close(w.exitChan)
+}
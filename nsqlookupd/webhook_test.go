@@ -0,0 +1,180 @@
+package nsqlookupd_test
+
+import (
+	"encoding/json"
+	"github.com/xswwhy/nsq/nsqlookupd"
+	"github.com/xswwhy/nsq/nsqlookupd/nsqlookupdtest"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的事件, fail返回true的请求回500
+type webhookRecorder struct {
+	mu     sync.Mutex
+	events []nsqlookupd.RegistrationEvent
+	times  []time.Time // 每一次请求的时间, 包括失败的
+	fail   func(attempt int) bool
+	block  chan struct{} // 不为nil的话, 请求一直等到block关闭
+	enter  chan struct{} // 每个请求开始的时候通知一下
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.enter != nil {
+		select {
+		case r.enter <- struct{}{}:
+		default:
+		}
+	}
+	if r.block != nil {
+		<-r.block
+	}
+	var e nsqlookupd.RegistrationEvent
+	err := json.NewDecoder(req.Body).Decode(&e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.times = append(r.times, time.Now())
+	if r.fail != nil && r.fail(len(r.times)) {
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	r.events = append(r.events, e)
+}
+
+func (r *webhookRecorder) received() []nsqlookupd.RegistrationEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]nsqlookupd.RegistrationEvent{}, r.events...)
+}
+
+func (r *webhookRecorder) attempts() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time{}, r.times...)
+}
+
+func topicKey(topic string) nsqlookupd.Registration {
+	return nsqlookupd.Registration{Namespace: "", Category: "topic", Key: topic, SubKey: ""}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	rec := &webhookRecorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	s := nsqlookupdtest.New(t, func(opts *nsqlookupd.Options) {
+		opts.WebhookURLs = []string{srv.URL}
+		opts.WebhookEvents = []string{nsqlookupd.EventRegistrationAdd, nsqlookupd.EventProducerAdd}
+	})
+
+	s.MustRegisterProducer(t, nsqlookupdtest.FakeProducer{
+		TCPPort:  4150,
+		HTTPPort: 4151,
+		Topics:   map[string][]string{"orders": nil},
+	})
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		for _, e := range rec.received() {
+			if e.Type == nsqlookupd.EventProducerAdd && e.Category == "topic" && e.Key == "orders" {
+				return e.Producer != nil && e.Producer.TCPPort == 4150
+			}
+		}
+		return false
+	}, "producer_add for topic(orders) delivered")
+	for _, e := range rec.received() {
+		if e.Type != nsqlookupd.EventRegistrationAdd && e.Type != nsqlookupd.EventProducerAdd {
+			t.Fatalf("event type %s should be filtered out", e.Type)
+		}
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	const backoff = 50 * time.Millisecond
+	rec := &webhookRecorder{fail: func(attempt int) bool { return attempt <= 2 }}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	s := nsqlookupdtest.New(t, func(opts *nsqlookupd.Options) {
+		opts.WebhookURLs = []string{srv.URL}
+		opts.WebhookEvents = []string{nsqlookupd.EventRegistrationAdd}
+		opts.WebhookBackoff = backoff
+		opts.WebhookMaxRetries = 2
+	})
+
+	s.DB.AddRegistration(topicKey("orders"))
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return len(rec.received()) == 1
+	}, "event delivered after retries")
+	times := rec.attempts()
+	if len(times) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(times))
+	}
+	// 等待时间每次翻倍
+	for i, want := range []time.Duration{backoff, 2 * backoff} {
+		if got := times[i+1].Sub(times[i]); got < want {
+			t.Fatalf("retry %d after %s, want at least %s", i+1, got, want)
+		}
+	}
+
+	// 超过重试次数就放弃, 不影响后面的事件
+	rec.mu.Lock()
+	rec.times = nil
+	rec.fail = func(attempt int) bool { return attempt <= 3 }
+	rec.mu.Unlock()
+	s.DB.AddRegistration(topicKey("dropped"))
+	s.DB.AddRegistration(topicKey("delivered"))
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return len(rec.received()) == 2
+	}, "event after a failed delivery is sent")
+	if got := rec.received()[1].Key; got != "delivered" {
+		t.Fatalf("expected topic(delivered), got %s", got)
+	}
+}
+
+func TestWebhookDropOnFull(t *testing.T) {
+	slow := &webhookRecorder{block: make(chan struct{}), enter: make(chan struct{}, 1)}
+	slowSrv := httptest.NewServer(slow)
+	defer slowSrv.Close()
+	defer close(slow.block)
+	fast := &webhookRecorder{}
+	fastSrv := httptest.NewServer(fast)
+	defer fastSrv.Close()
+	s := nsqlookupdtest.New(t, func(opts *nsqlookupd.Options) {
+		opts.WebhookURLs = []string{slowSrv.URL, fastSrv.URL}
+		opts.WebhookEvents = []string{nsqlookupd.EventRegistrationAdd}
+		opts.WebhookQueueSize = 1
+	})
+
+	// 第一个事件正在发给slow, 队列里还能再放一个, 剩下的丢掉
+	s.DB.AddRegistration(topicKey("t0"))
+	select {
+	case <-slow.enter:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("slow webhook never received a request")
+	}
+	// fast的队列也只有1, 每次等它发完
+	for i, topic := range []string{"t1", "t2", "t3", "t4"} {
+		n := i + 1
+		nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+			return len(fast.received()) == n
+		}, "fast webhook is not blocked by the slow one")
+		s.DB.AddRegistration(topicKey(topic))
+	}
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return len(fast.received()) == 5
+	}, "fast webhook gets every event")
+
+	slow.block <- struct{}{}
+	slow.block <- struct{}{}
+	nsqlookupdtest.Eventually(t, 5*time.Second, func() bool {
+		return len(slow.received()) == 2
+	}, "slow webhook gets the in-flight and the queued event")
+	time.Sleep(100 * time.Millisecond)
+	events := slow.received()
+	if len(events) != 2 || events[0].Key != "t0" || events[1].Key != "t1" {
+		t.Fatalf("slow webhook should only get t0 and t1, got %+v", events)
+	}
+}